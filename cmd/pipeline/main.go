@@ -5,6 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/pipeline"
@@ -26,6 +29,8 @@ func main() {
 			fmt.Fprintln(os.Stderr, err.Error())
 			os.Exit(1)
 		}
+	case "watch":
+		watch(os.Args[2:])
 	default:
 		usage()
 		os.Exit(2)
@@ -36,19 +41,32 @@ func usage() {
 	fmt.Fprintf(os.Stderr, `finance-pipeline-gcp
 
 Commands:
-  run     Run recon + auditpack on two CSVs
+  run     Run recon + auditpack on two (or more, named) CSVs
   server  Cloud Run handler for Eventarc/GCS (downloads in/<runID>/left.csv + right.csv, uploads out/<runID>/...)
+  watch   Poll a local directory for in/<runID>/right.csv and run each settled run once
 
 Examples:
   go run ./cmd/pipeline run --left left.csv --right right.csv --out ./out
+  go run ./cmd/pipeline run --input bank=bank.csv --input ledger=ledger.csv --input processor=processor.csv --mode hub --out ./out
+  go run ./cmd/pipeline run --left bank.csv --right ledger.csv --engine native --spec spec.json --out ./out
   go run ./cmd/pipeline server
+  go run ./cmd/pipeline watch --in ./inbox --out ./outbox
 
 Env (server):
-  INPUT_BUCKET    (required; server ignores events from other buckets)
-  OUTPUT_BUCKET   (required)
+  INPUT_BUCKET    (required; server ignores events from other buckets; <bucket>, gs://<bucket>, s3://<bucket>, az://<container> or file:///<dir>)
+  OUTPUT_BUCKET   (required; same forms as INPUT_BUCKET)
   INPUT_PREFIX    (default: in/)
   OUTPUT_PREFIX   (default: out/)
   PORT            (default: 8080)
+  IMPERSONATE_SERVICE_ACCOUNT (optional; GCS buckets only; INPUT_/OUTPUT_ prefixed forms override per bucket)
+  OIDC_AUDIENCE   (optional; verify push bearer tokens; see OIDC_ISSUERS, OIDC_ALLOWED_EMAILS, OIDC_JWKS_URL)
+  INPUTS          (default: left,right; input names read from in/<runID>/<name>.csv; the last one is the right.csv-mode trigger)
+  RECON_ENGINE    (default: external; native reconciles in-process instead of running the recon binary)
+  RECON_SPEC      (optional; local path of a JSON recon spec choosing key/compared/ignored columns and tolerances; needs RECON_ENGINE=native)
+  RECON_MODE      (default: pairwise; hub reconciles RECON_HUB, default the first input, against each other input)
+  TRIGGER_MODE    (default: right; both triggers on any input once all exist; manifest triggers on in/<runID>/_READY.json or manifest.json listing input sizes and digests)
+  RUN_LEASE       (default: 10m; age after which an in-flight _RUNNING.json claim may be taken over; must exceed 6m)
+  REJECT_LEFT_AFTER_RIGHT (default: false; error when left.csv is newer than right.csv)
 `)
 }
 
@@ -58,20 +76,46 @@ func run(args []string) {
 	right := fs.String("right", "", "path to right.csv")
 	out := fs.String("out", "./out", "output base directory")
 	forceID := fs.String("run-id", "", "optional stable run id (default: sha256(left+right) prefix)")
+	engine := fs.String("engine", "external", "recon engine: external (the recon binary) or native (in-process)")
+	spec := fs.String("spec", "", "recon spec (JSON: key, compare, ignore, rename_right, tolerances); needs --engine native")
 	reconBin := fs.String("recon", "recon", "path to recon binary (or recon on PATH)")
 	auditBin := fs.String("auditpack", "auditpack", "path to auditpack binary (or auditpack on PATH)")
 	label := fs.String("label", "", "optional auditpack label (default: job:<run-id>)")
+	var inputs inputFlags
+	fs.Var(&inputs, "input", "named input as name=path (repeatable; replaces --left/--right), e.g. --input bank=bank.csv")
+	mode := fs.String("mode", "", "recon pairs for named inputs: pairwise (default) or hub")
+	hub := fs.String("hub", "", "hub input; needs --mode hub (default: the first --input)")
 	_ = fs.Parse(args)
 
-	if *left == "" || *right == "" {
-		fmt.Fprintln(os.Stderr, "ERROR: --left and --right are required")
+	if len(inputs) > 0 && (*left != "" || *right != "") {
+		fmt.Fprintln(os.Stderr, "ERROR: use either --input or --left/--right")
 		os.Exit(2)
 	}
+	if len(inputs) == 0 && (*left == "" || *right == "") {
+		fmt.Fprintln(os.Stderr, "ERROR: --left and --right (or two or more --input) are required")
+		os.Exit(2)
+	}
+	if len(inputs) == 0 && (*mode != "" || *hub != "") {
+		fmt.Fprintln(os.Stderr, "ERROR: --mode and --hub need --input (not --left/--right)")
+		os.Exit(2)
+	}
+	if *hub != "" && *mode != pipeline.ModeHub {
+		fmt.Fprintln(os.Stderr, "ERROR: --hub needs --mode hub")
+		os.Exit(2)
+	}
+
+	paths := []string{*left, *right}
+	if len(inputs) > 0 {
+		paths = paths[:0]
+		for _, in := range inputs {
+			paths = append(paths, in.Path)
+		}
+	}
 
 	id := *forceID
 	if id == "" {
 		var err error
-		id, err = runid.FromFiles(*left, *right)
+		id, err = runid.FromFiles(paths...)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: compute run id: %v\n", err)
 			os.Exit(1)
@@ -84,6 +128,11 @@ func run(args []string) {
 	res, err := pipeline.Run(ctx, pipeline.Config{
 		LeftPath:     *left,
 		RightPath:    *right,
+		Inputs:       inputs,
+		Mode:         *mode,
+		Hub:          *hub,
+		Engine:       *engine,
+		SpecPath:     *spec,
 		OutBase:      *out,
 		RunID:        id,
 		ReconBin:     *reconBin,
@@ -98,3 +147,78 @@ func run(args []string) {
 		os.Exit(1)
 	}
 }
+
+func watch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	in := fs.String("in", "", "input directory (holds <in-prefix><runID>/left.csv + right.csv)")
+	out := fs.String("out", "", "output directory (receives <out-prefix><runID>/...)")
+	inPrefix := fs.String("in-prefix", "in/", "input prefix under --in")
+	outPrefix := fs.String("out-prefix", "", "output prefix under --out")
+	interval := fs.Duration("interval", 2*time.Second, "poll interval")
+	settle := fs.Duration("settle", 5*time.Second, "time both inputs must keep the same size and mtime before a run starts")
+	lease := fs.Duration("lease", 10*time.Minute, "age after which an in-flight _RUNNING.json claim may be taken over (must exceed 6m)")
+	engine := fs.String("engine", "external", "recon engine: external (the recon binary) or native (in-process)")
+	spec := fs.String("spec", "", "recon spec (JSON: key, compare, ignore, rename_right, tolerances); needs --engine native")
+	reconBin := fs.String("recon", "recon", "path to recon binary (or recon on PATH)")
+	auditBin := fs.String("auditpack", "auditpack", "path to auditpack binary (or auditpack on PATH)")
+	once := fs.Bool("once", false, "scan, wait --settle, run what is ready, then exit")
+	inputs := fs.String("inputs", "", "comma-separated input names read from <runID>/<name>.csv; the last triggers (default: left,right)")
+	mode := fs.String("mode", "", "recon pairs for named inputs: pairwise (default) or hub")
+	hub := fs.String("hub", "", "hub input; needs --mode hub (default: the first input)")
+	_ = fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: --in and --out are required")
+		os.Exit(2)
+	}
+
+	var names []string
+	if *inputs != "" {
+		names = strings.Split(*inputs, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := server.Watch(ctx, server.WatchConfig{
+		InDir:        *in,
+		OutDir:       *out,
+		InPrefix:     *inPrefix,
+		OutPrefix:    *outPrefix,
+		Interval:     *interval,
+		Settle:       *settle,
+		Lease:        *lease,
+		Inputs:       names,
+		Mode:         *mode,
+		Hub:          *hub,
+		Engine:       *engine,
+		SpecPath:     *spec,
+		ReconBin:     *reconBin,
+		AuditpackBin: *auditBin,
+		Once:         *once,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// inputFlags collects repeated --input name=path flags.
+type inputFlags []pipeline.Input
+
+func (f *inputFlags) String() string {
+	var parts []string
+	for _, in := range *f {
+		parts = append(parts, in.Name+"="+in.Path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *inputFlags) Set(v string) error {
+	name, path, ok := strings.Cut(v, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("want name=path, got %q", v)
+	}
+	*f = append(*f, pipeline.Input{Name: name, Path: path})
+	return nil
+}
@@ -0,0 +1,699 @@
+// Package gcsfake is an in-memory stand-in for the subset of the Cloud Storage
+// JSON API used by this repo: metadata GET, media download, list, delete,
+// media/multipart/resumable upload and generation preconditions. Faults (429,
+// 503, slow and truncated bodies) can be injected per request so retry and
+// integrity paths are testable without a network.
+package gcsfake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault alters the response to matching requests.
+type Fault struct {
+	// Method and Object restrict which requests match ("" matches any).
+	// Object matches the exact object name.
+	Method string
+	Object string
+
+	// Status, when non-zero, replaces the response with this status code.
+	Status int
+	// Delay sleeps before the response body is written (slow body).
+	Delay time.Duration
+	// Truncate, when > 0, sends only the first Truncate bytes of a media
+	// download while still advertising the full Content-Length.
+	Truncate int
+	// Corrupt flips a byte of a media download (hash headers still describe
+	// the stored bytes) or of an upload body before its digests are checked.
+	Corrupt bool
+	// Stall makes a resumable session PUT drop its chunk and answer 308 with
+	// the unchanged persisted range, as a stuck session would.
+	Stall bool
+
+	// After skips this many matching requests before the fault applies.
+	After int
+	// Times is how many matching requests are affected (default 1).
+	Times int
+}
+
+type object struct {
+	data           []byte
+	generation     int64
+	metageneration int64
+	contentType    string
+	updated        time.Time
+}
+
+type upload struct {
+	bucket string
+	meta   uploadMetadata
+	conds  url.Values
+	data   []byte
+}
+
+// Server is a fake GCS endpoint backed by memory.
+type Server struct {
+	// Token, when set, must be presented as "Authorization: Bearer <Token>".
+	Token string
+
+	mu      sync.Mutex
+	srv     *httptest.Server
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	faults  []*Fault
+	log     []string
+	gen     int64
+	nextID  int
+	now     func() time.Time
+}
+
+// New starts a fake server. Callers must Close it.
+func New() *Server {
+	s := &Server{
+		buckets: map[string]map[string]*object{},
+		uploads: map[string]*upload{},
+		now:     time.Now,
+	}
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+func (s *Server) Close() { s.srv.Close() }
+
+// URL is the base URL of the fake (e.g. http://127.0.0.1:12345).
+func (s *Server) URL() string { return s.srv.URL }
+
+// Transport returns a RoundTripper that sends every request to the fake,
+// whatever host it was addressed to (e.g. storage.googleapis.com).
+func (s *Server) Transport() http.RoundTripper {
+	u, _ := url.Parse(s.srv.URL)
+	return rewriteTransport{scheme: u.Scheme, host: u.Host, next: s.srv.Client().Transport}
+}
+
+type rewriteTransport struct {
+	scheme, host string
+	next         http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r2 := r.Clone(r.Context())
+	r2.URL.Scheme = t.scheme
+	r2.URL.Host = t.host
+	r2.Host = t.host
+	return t.next.RoundTrip(r2)
+}
+
+// SetClock overrides the time used for object "updated" timestamps.
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// AddFault queues a fault. Faults are consulted in the order added.
+func (s *Server) AddFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Times <= 0 {
+		f.Times = 1
+	}
+	s.faults = append(s.faults, &f)
+}
+
+// PutObject stores data directly and returns its generation.
+func (s *Server) PutObject(bucket, name string, data []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store(bucket, name, data, "application/octet-stream").generation
+}
+
+// DeleteObject removes an object directly.
+func (s *Server) DeleteObject(bucket, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], name)
+}
+
+// Object returns the current content of an object.
+func (s *Server) Object(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), o.data...), true
+}
+
+// Generation returns the current generation of an object (0 if missing).
+func (s *Server) Generation(bucket, name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.buckets[bucket][name]; ok {
+		return o.generation
+	}
+	return 0
+}
+
+// Names returns the sorted object names in bucket with the given prefix.
+func (s *Server) Names(bucket, prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for n := range s.buckets[bucket] {
+		if strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Log returns one "<op> <bucket>/<object>" line per handled request, in order.
+// Ops are: meta, media, list, delete, upload, upload-chunk.
+func (s *Server) Log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+func (s *Server) store(bucket, name string, data []byte, contentType string) *object {
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]*object{}
+	}
+	s.gen++
+	o := &object{
+		data:           append([]byte(nil), data...),
+		generation:     s.gen,
+		metageneration: 1,
+		contentType:    contentType,
+		updated:        s.now().UTC(),
+	}
+	s.buckets[bucket][name] = o
+	return o
+}
+
+// takeFault returns the first matching fault and consumes one use of it.
+func (s *Server) takeFault(method, name string) *Fault {
+	for i, f := range s.faults {
+		if f.Method != "" && f.Method != method {
+			continue
+		}
+		if f.Object != "" && f.Object != name {
+			continue
+		}
+		if f.After > 0 {
+			f.After--
+			return nil
+		}
+		out := *f
+		f.Times--
+		if f.Times <= 0 {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		}
+		return &out
+	}
+	return nil
+}
+
+// CRC32C returns the base64 big-endian CRC32C of b, as GCS reports it.
+func CRC32C(b []byte) string {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(buf[:])
+}
+
+// MD5 returns the base64 MD5 of b, as GCS reports it.
+func MD5(b []byte) string {
+	sum := md5.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type objectResource struct {
+	Kind           string `json:"kind"`
+	Bucket         string `json:"bucket"`
+	Name           string `json:"name"`
+	Generation     string `json:"generation"`
+	Metageneration string `json:"metageneration"`
+	ContentType    string `json:"contentType"`
+	Size           string `json:"size"`
+	MD5Hash        string `json:"md5Hash"`
+	CRC32C         string `json:"crc32c"`
+	Updated        string `json:"updated"`
+}
+
+func resource(bucket, name string, o *object) objectResource {
+	return objectResource{
+		Kind:           "storage#object",
+		Bucket:         bucket,
+		Name:           name,
+		Generation:     strconv.FormatInt(o.generation, 10),
+		Metageneration: strconv.FormatInt(o.metageneration, 10),
+		ContentType:    o.contentType,
+		Size:           strconv.Itoa(len(o.data)),
+		MD5Hash:        MD5(o.data),
+		CRC32C:         CRC32C(o.data),
+		Updated:        o.updated.Format(time.RFC3339Nano),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{"error": map[string]any{"code": status, "message": msg}})
+}
+
+// checkPreconditions applies ifGenerationMatch / ifGenerationNotMatch against
+// the current object (nil if missing). It returns false after writing 412.
+func checkPreconditions(w http.ResponseWriter, q url.Values, cur *object) bool {
+	var gen int64
+	if cur != nil {
+		gen = cur.generation
+	}
+	if v := q.Get("ifGenerationMatch"); v != "" {
+		want, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || want != gen {
+			writeError(w, http.StatusPreconditionFailed, "ifGenerationMatch failed")
+			return false
+		}
+	}
+	if v := q.Get("ifGenerationNotMatch"); v != "" {
+		notWant, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || notWant == gen {
+			writeError(w, http.StatusPreconditionFailed, "ifGenerationNotMatch failed")
+			return false
+		}
+	}
+	return true
+}
+
+// route splits an escaped request path into (kind, bucket, object).
+// kind is one of: "objects" (/storage/v1/b/<b>/o[/<o>]), "download", "upload".
+func route(escapedPath string) (kind, bucket, name string, ok bool) {
+	p := escapedPath
+	switch {
+	case strings.HasPrefix(p, "/storage/v1/b/"):
+		kind, p = "objects", strings.TrimPrefix(p, "/storage/v1/b/")
+	case strings.HasPrefix(p, "/download/storage/v1/b/"):
+		kind, p = "download", strings.TrimPrefix(p, "/download/storage/v1/b/")
+	case strings.HasPrefix(p, "/upload/storage/v1/b/"):
+		kind, p = "upload", strings.TrimPrefix(p, "/upload/storage/v1/b/")
+	default:
+		return "", "", "", false
+	}
+	parts := strings.SplitN(p, "/", 3)
+	if len(parts) < 2 || parts[1] != "o" {
+		return "", "", "", false
+	}
+	b, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", "", "", false
+	}
+	if len(parts) == 3 {
+		n, err := url.PathUnescape(parts[2])
+		if err != nil {
+			return "", "", "", false
+		}
+		name = n
+	}
+	return kind, b, name, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind, bucket, name, ok := route(r.URL.EscapedPath())
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown path")
+		return
+	}
+	q := r.URL.Query()
+	if kind == "upload" && name == "" {
+		name = q.Get("name")
+	}
+
+	s.mu.Lock()
+	f := s.takeFault(r.Method, name)
+	s.mu.Unlock()
+
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusUnauthorized, "bad token")
+		return
+	}
+	if f != nil && f.Status != 0 {
+		_, _ = io.Copy(io.Discard, r.Body)
+		writeError(w, f.Status, "injected fault")
+		return
+	}
+
+	switch {
+	case kind == "objects" && r.Method == http.MethodGet && name == "":
+		s.list(w, bucket, q)
+	case (kind == "objects" || kind == "download") && r.Method == http.MethodGet:
+		media := kind == "download" || q.Get("alt") == "media"
+		s.get(w, bucket, name, q, media, f)
+	case kind == "objects" && r.Method == http.MethodDelete:
+		s.delete(w, bucket, name, q)
+	case kind == "upload" && r.Method == http.MethodPost:
+		s.upload(w, r, bucket, name, q, f)
+	case kind == "upload" && r.Method == http.MethodPut && q.Get("upload_id") != "":
+		s.uploadChunk(w, r, q.Get("upload_id"), f)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported")
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket string, q url.Values) {
+	s.mu.Lock()
+	s.log = append(s.log, "list "+bucket+"/"+q.Get("prefix"))
+	var names []string
+	for n := range s.buckets[bucket] {
+		if strings.HasPrefix(n, q.Get("prefix")) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	start := 0
+	if tok := q.Get("pageToken"); tok != "" {
+		start, _ = strconv.Atoi(tok)
+	}
+	max := 1000
+	if v, err := strconv.Atoi(q.Get("maxResults")); err == nil && v > 0 {
+		max = v
+	}
+	if start > len(names) {
+		start = len(names)
+	}
+	end := start + max
+	if end > len(names) {
+		end = len(names)
+	}
+
+	items := []objectResource{}
+	for _, n := range names[start:end] {
+		items = append(items, resource(bucket, n, s.buckets[bucket][n]))
+	}
+	s.mu.Unlock()
+
+	resp := map[string]any{"kind": "storage#objects", "items": items}
+	if end < len(names) {
+		resp["nextPageToken"] = strconv.Itoa(end)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) get(w http.ResponseWriter, bucket, name string, q url.Values, media bool, f *Fault) {
+	s.mu.Lock()
+	op := "meta"
+	if media {
+		op = "media"
+	}
+	s.log = append(s.log, op+" "+bucket+"/"+name)
+	o := s.buckets[bucket][name]
+	if o != nil && q.Get("generation") != "" && q.Get("generation") != strconv.FormatInt(o.generation, 10) {
+		o = nil // only the live generation is retained
+	}
+	var (
+		res  objectResource
+		data []byte
+	)
+	if o != nil {
+		res = resource(bucket, name, o)
+		data = o.data
+	}
+	s.mu.Unlock()
+
+	if o == nil {
+		writeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	if !checkPreconditions(w, q, o) {
+		return
+	}
+	if !media {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	w.Header().Set("Content-Type", res.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Goog-Generation", res.Generation)
+	w.Header().Set("X-Goog-Hash", "crc32c="+res.CRC32C+",md5="+res.MD5Hash)
+	w.WriteHeader(http.StatusOK)
+
+	if f != nil && f.Delay > 0 {
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+		time.Sleep(f.Delay)
+	}
+	if f != nil && f.Corrupt && len(data) > 0 {
+		data = corrupt(data)
+	}
+	if f != nil && f.Truncate > 0 && f.Truncate < len(data) {
+		_, _ = w.Write(data[:f.Truncate])
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+func (s *Server) delete(w http.ResponseWriter, bucket, name string, q url.Values) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = append(s.log, "delete "+bucket+"/"+name)
+	o := s.buckets[bucket][name]
+	if o == nil {
+		writeError(w, http.StatusNotFound, "no such object")
+		return
+	}
+	if !checkPreconditions(w, q, o) {
+		return
+	}
+	delete(s.buckets[bucket], name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type uploadMetadata struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	CRC32C      string `json:"crc32c"`
+	MD5Hash     string `json:"md5Hash"`
+}
+
+// finish commits an upload after checking hashes and preconditions.
+// Callers hold s.mu.
+func (s *Server) finish(w http.ResponseWriter, bucket string, meta uploadMetadata, conds url.Values, data []byte) {
+	if meta.Name == "" {
+		writeError(w, http.StatusBadRequest, "missing object name")
+		return
+	}
+	if meta.CRC32C != "" && meta.CRC32C != CRC32C(data) {
+		writeError(w, http.StatusBadRequest, "crc32c mismatch")
+		return
+	}
+	if meta.MD5Hash != "" && meta.MD5Hash != MD5(data) {
+		writeError(w, http.StatusBadRequest, "md5Hash mismatch")
+		return
+	}
+	if !checkPreconditions(w, conds, s.buckets[bucket][meta.Name]) {
+		return
+	}
+	ct := meta.ContentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	o := s.store(bucket, meta.Name, data, ct)
+	writeJSON(w, http.StatusOK, resource(bucket, meta.Name, o))
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, bucket, name string, q url.Values, f *Fault) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body")
+		return
+	}
+
+	switch q.Get("uploadType") {
+	case "media":
+		if f != nil && f.Corrupt {
+			body = corrupt(body)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.log = append(s.log, "upload "+bucket+"/"+name)
+		s.finish(w, bucket, uploadMetadata{Name: name, ContentType: r.Header.Get("Content-Type")}, q, body)
+
+	case "multipart":
+		meta, data, err := parseMultipart(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if meta.Name == "" {
+			meta.Name = name
+		}
+		if f != nil && f.Corrupt {
+			data = corrupt(data)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.log = append(s.log, "upload "+bucket+"/"+meta.Name)
+		s.finish(w, bucket, meta, q, data)
+
+	case "resumable":
+		var meta uploadMetadata
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &meta); err != nil {
+				writeError(w, http.StatusBadRequest, "bad metadata")
+				return
+			}
+		}
+		if meta.Name == "" {
+			meta.Name = name
+		}
+		s.mu.Lock()
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket: bucket, meta: meta, conds: q}
+		s.mu.Unlock()
+
+		loc := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&upload_id=%s",
+			s.srv.URL, url.PathEscape(bucket), id)
+		w.Header().Set("Location", loc)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported uploadType")
+	}
+}
+
+// uploadChunk handles a resumable session PUT with Content-Range
+// "bytes <first>-<last>/<total|*>" or "bytes */<total|*>" (status query).
+func (s *Server) uploadChunk(w http.ResponseWriter, r *http.Request, id string, f *Fault) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body")
+		return
+	}
+	if f != nil && f.Corrupt {
+		body = corrupt(body)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[id]
+	if u == nil {
+		writeError(w, http.StatusNotFound, "no such upload session")
+		return
+	}
+	s.log = append(s.log, "upload-chunk "+u.bucket+"/"+u.meta.Name)
+
+	first, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if first >= 0 && (f == nil || !f.Stall) {
+		if first > int64(len(u.data)) {
+			writeError(w, http.StatusBadRequest, "chunk beyond persisted offset")
+			return
+		}
+		// Overlapping resends are allowed; keep the persisted prefix.
+		u.data = append(u.data[:first], body...)
+	}
+
+	if total >= 0 && int64(len(u.data)) == total {
+		delete(s.uploads, id)
+		s.finish(w, u.bucket, u.meta, u.conds, u.data)
+		return
+	}
+
+	if len(u.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// corrupt returns a copy of b with its first byte flipped.
+func corrupt(b []byte) []byte {
+	out := append([]byte(nil), b...)
+	if len(out) > 0 {
+		out[0] ^= 0xff
+	}
+	return out
+}
+
+// parseContentRange returns first (-1 for "*") and total (-1 for "*").
+func parseContentRange(v string) (first, total int64, err error) {
+	v = strings.TrimSpace(strings.TrimPrefix(v, "bytes "))
+	rng, tot, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", v)
+	}
+	total = -1
+	if tot != "*" {
+		if total, err = strconv.ParseInt(tot, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("bad Content-Range %q", v)
+		}
+	}
+	if rng == "*" {
+		return -1, total, nil
+	}
+	a, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", v)
+	}
+	if first, err = strconv.ParseInt(a, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", v)
+	}
+	return first, total, nil
+}
+
+func parseMultipart(contentType string, body []byte) (uploadMetadata, []byte, error) {
+	var meta uploadMetadata
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != "multipart/related" {
+		return meta, nil, fmt.Errorf("expected multipart/related")
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return meta, nil, fmt.Errorf("missing metadata part")
+	}
+	if err := json.NewDecoder(part).Decode(&meta); err != nil {
+		return meta, nil, fmt.Errorf("bad metadata part")
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		return meta, nil, fmt.Errorf("missing media part")
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		return meta, nil, fmt.Errorf("read media part")
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = part.Header.Get("Content-Type")
+	}
+	return meta, data, nil
+}
@@ -0,0 +1,79 @@
+package gcsfake
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func do(t *testing.T, method, u, contentRange, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentRange != "" {
+		req.Header.Set("Content-Range", contentRange)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	resp := do(t, http.MethodPost, s.URL()+"/upload/storage/v1/b/bkt/o?uploadType=resumable&name=out%2Fpack.zip", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("initiate status=%d", resp.StatusCode)
+	}
+	session := resp.Header.Get("Location")
+
+	resp = do(t, http.MethodPut, session, "bytes 0-3/*", "abcd")
+	if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Range") != "bytes=0-3" {
+		t.Fatalf("chunk 1 status=%d range=%q", resp.StatusCode, resp.Header.Get("Range"))
+	}
+
+	resp = do(t, http.MethodPut, session, "bytes */*", "")
+	if resp.Header.Get("Range") != "bytes=0-3" {
+		t.Fatalf("status query range=%q", resp.Header.Get("Range"))
+	}
+
+	resp = do(t, http.MethodPut, session, "bytes 4-5/6", "ef")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("final chunk status=%d", resp.StatusCode)
+	}
+	if b, ok := s.Object("bkt", "out/pack.zip"); !ok || string(b) != "abcdef" {
+		t.Fatalf("object=%q ok=%v", b, ok)
+	}
+}
+
+func TestPreconditionsAndFaults(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	u := s.URL() + "/upload/storage/v1/b/bkt/o?uploadType=media&name=claim&ifGenerationMatch=0"
+	if resp := do(t, http.MethodPost, u, "", "a"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first create status=%d", resp.StatusCode)
+	}
+	if resp := do(t, http.MethodPost, u, "", "b"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("second create status=%d want 412", resp.StatusCode)
+	}
+
+	s.AddFault(Fault{Method: http.MethodGet, Status: http.StatusServiceUnavailable, Times: 2})
+	meta := s.URL() + "/storage/v1/b/bkt/o/claim"
+	for i := 0; i < 2; i++ {
+		if resp := do(t, http.MethodGet, meta, "", ""); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("fault %d status=%d", i, resp.StatusCode)
+		}
+	}
+	if resp := do(t, http.MethodGet, meta, "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("after faults status=%d", resp.StatusCode)
+	}
+}
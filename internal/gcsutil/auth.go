@@ -0,0 +1,531 @@
+package gcsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenURL          = "https://oauth2.googleapis.com/token"
+	defaultIAMCredentialsURL = "https://iamcredentials.googleapis.com"
+	// cloudPlatformScope is what Application Default Credentials request; IAM
+	// on the buckets decides what the identity can actually do.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	jwtBearerGrant     = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+	tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType    = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// tokenRefreshEarly is how long before expiry a cached token is replaced
+// (capped at half the token's lifetime).
+const tokenRefreshEarly = 5 * time.Minute
+
+// TokenSource supplies bearer tokens for Google API requests. GCS calls
+// consult it per request, so a long run picks up refreshed tokens.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a fixed token; "" sends no Authorization header (emulators).
+type StaticToken string
+
+func (t StaticToken) Token(context.Context) (string, error) { return string(t), nil }
+
+// cachedToken caches tokens from fetch until shortly before they expire. It
+// is safe for concurrent use; one caller refreshes while the others wait.
+type cachedToken struct {
+	fetch func(context.Context) (tokenResp, error)
+	now   func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	expiry    time.Time
+	refreshAt time.Time
+}
+
+func newCachedToken(fetch func(context.Context) (tokenResp, error)) *cachedToken {
+	return &cachedToken{fetch: fetch, now: time.Now}
+}
+
+func (c *cachedToken) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.token != "" && now.Before(c.refreshAt) {
+		return c.token, nil
+	}
+	tr, err := c.fetch(ctx)
+	if err != nil {
+		if c.token != "" && now.Before(c.expiry) {
+			// Refreshing ahead of expiry failed; the cached token still works.
+			return c.token, nil
+		}
+		return "", err
+	}
+	lifetime := time.Duration(tr.ExpiresIn) * time.Second
+	early := tokenRefreshEarly
+	if early > lifetime/2 {
+		early = lifetime / 2
+	}
+	c.token = tr.AccessToken
+	c.expiry = now.Add(lifetime)
+	c.refreshAt = c.expiry.Add(-early)
+	return c.token, nil
+}
+
+// NewTokenSource returns a token source for the current environment (see
+// AccessToken for the precedence). Fetched tokens are cached.
+func NewTokenSource() (TokenSource, error) {
+	if storageEmulatorHost() != "" {
+		return StaticToken(""), nil
+	}
+	if v := strings.TrimSpace(os.Getenv("GCP_ACCESS_TOKEN")); v != "" {
+		return StaticToken(v), nil
+	}
+	cred, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if cred != nil {
+		return newCachedToken(func(ctx context.Context) (tokenResp, error) {
+			return credentialsToken(ctx, cred)
+		}), nil
+	}
+	return newCachedToken(metadataToken), nil
+}
+
+var (
+	defaultTSMu  sync.Mutex
+	defaultTSKey string
+	defaultTS    TokenSource
+)
+
+// DefaultTokenSource returns the process-wide token source, shared by every
+// store OpenStore creates so concurrent handlers reuse one cached token. It
+// is rebuilt if the credential environment changes.
+func DefaultTokenSource() (TokenSource, error) {
+	key := strings.Join([]string{
+		os.Getenv("STORAGE_EMULATOR_HOST"),
+		os.Getenv("GCP_ACCESS_TOKEN"),
+		os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
+		os.Getenv("GCP_TOKEN_URL"),
+		os.Getenv("GCE_METADATA_HOST"),
+		os.Getenv("IAM_CREDENTIALS_URL"),
+	}, "\x00")
+
+	defaultTSMu.Lock()
+	defer defaultTSMu.Unlock()
+	if defaultTS != nil && key == defaultTSKey {
+		return defaultTS, nil
+	}
+	ts, err := NewTokenSource()
+	if err != nil {
+		return nil, err
+	}
+	defaultTS, defaultTSKey = ts, key
+	// Sources impersonating via the old default can no longer be requested.
+	impersonatedMu.Lock()
+	clear(impersonated)
+	impersonatedMu.Unlock()
+	return ts, nil
+}
+
+type impersonationKey struct {
+	base           TokenSource
+	serviceAccount string
+	url            string // IAM Credentials endpoint
+}
+
+var (
+	impersonatedMu sync.Mutex
+	impersonated   = map[impersonationKey]TokenSource{}
+)
+
+// ImpersonatedTokenSource returns a source of tokens for serviceAccount,
+// minted with base's token (the caller needs roles/iam.serviceAccountTokenCreator
+// on it). Sources are shared per (base, serviceAccount, IAM_CREDENTIALS_URL),
+// so each identity keeps its own cached token and expiry. Replacing the
+// default source empties this cache, so stale bases are not kept.
+func ImpersonatedTokenSource(base TokenSource, serviceAccount string) TokenSource {
+	k := impersonationKey{base: base, serviceAccount: serviceAccount, url: iamCredentialsURL()}
+
+	impersonatedMu.Lock()
+	defer impersonatedMu.Unlock()
+	if ts, ok := impersonated[k]; ok {
+		return ts
+	}
+	ts := newImpersonatedToken(base, serviceAccount)
+	impersonated[k] = ts
+	return ts
+}
+
+func newImpersonatedToken(base TokenSource, serviceAccount string) *cachedToken {
+	u := iamCredentialsURL() + "/v1/projects/-/serviceAccounts/" + url.PathEscape(serviceAccount) + ":generateAccessToken"
+	return newCachedToken(func(ctx context.Context) (tokenResp, error) {
+		return impersonate(ctx, base, u)
+	})
+}
+
+// iamCredentialsURL returns the IAM Credentials API base (IAM_CREDENTIALS_URL for tests).
+func iamCredentialsURL() string {
+	if v := strings.TrimRight(strings.TrimSpace(os.Getenv("IAM_CREDENTIALS_URL")), "/"); v != "" {
+		return v
+	}
+	return defaultIAMCredentialsURL
+}
+
+// metadataToken fetches the instance service account's token.
+func metadataToken(ctx context.Context) (tokenResp, error) {
+	return fetchToken(ctx, "metadata token", func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataTokenURL(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return req, nil
+	})
+}
+
+// credentialsFile is the subset of a GOOGLE_APPLICATION_CREDENTIALS file we use.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	// external_account (workload identity federation)
+	Audience                       string            `json:"audience"`
+	SubjectTokenType               string            `json:"subject_token_type"`
+	TokenURL                       string            `json:"token_url"`
+	ServiceAccountImpersonationURL string            `json:"service_account_impersonation_url"`
+	CredentialSource               *credentialSource `json:"credential_source"`
+}
+
+// credentialSource says where an external account's subject token comes from.
+type credentialSource struct {
+	File    string            `json:"file"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Format  struct {
+		Type                  string `json:"type"` // "text" (default) or "json"
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+// loadCredentials reads GOOGLE_APPLICATION_CREDENTIALS (nil if unset).
+func loadCredentials() (*credentialsFile, error) {
+	p := strings.TrimSpace(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	if p == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	var c credentialsFile
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("credentials %s: %w", p, err)
+	}
+	return &c, nil
+}
+
+// tokenURL returns the OAuth token endpoint: GCP_TOKEN_URL, else the key
+// file's token_uri, else Google's.
+func (c *credentialsFile) tokenURL() string {
+	if v := strings.TrimSpace(os.Getenv("GCP_TOKEN_URL")); v != "" {
+		return v
+	}
+	if c.TokenURI != "" {
+		return c.TokenURI
+	}
+	return defaultTokenURL
+}
+
+// credentialsToken mints a token for a credentials file.
+func credentialsToken(ctx context.Context, c *credentialsFile) (tokenResp, error) {
+	switch c.Type {
+	case "service_account":
+		return serviceAccountToken(ctx, c)
+	case "external_account":
+		return externalAccountToken(ctx, c)
+	default:
+		return tokenResp{}, fmt.Errorf("credentials: unsupported type %q", c.Type)
+	}
+}
+
+// serviceAccountToken signs an RS256 JWT assertion with the key and exchanges
+// it at the token endpoint (RFC 7523).
+func serviceAccountToken(ctx context.Context, c *credentialsFile) (tokenResp, error) {
+	if c.ClientEmail == "" || c.PrivateKey == "" {
+		return tokenResp{}, errors.New("credentials: service account key missing client_email or private_key")
+	}
+	key, err := parseRSAKey(c.PrivateKey)
+	if err != nil {
+		return tokenResp{}, err
+	}
+	aud := c.tokenURL()
+	now := time.Now()
+	assertion, err := signJWT(key, c.PrivateKeyID, map[string]any{
+		"iss":   c.ClientEmail,
+		"scope": cloudPlatformScope,
+		"aud":   aud,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return tokenResp{}, err
+	}
+	form := url.Values{"grant_type": {jwtBearerGrant}, "assertion": {assertion}}
+	return fetchToken(ctx, "service account token", func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, aud, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+}
+
+// externalAccountToken exchanges a subject token (e.g. an OIDC token from
+// the runner's identity provider) at the STS endpoint (RFC 8693), then
+// optionally impersonates a service account with the federated token.
+func externalAccountToken(ctx context.Context, c *credentialsFile) (tokenResp, error) {
+	if c.Audience == "" || c.TokenURL == "" || c.CredentialSource == nil {
+		return tokenResp{}, errors.New("credentials: external_account needs audience, token_url and credential_source")
+	}
+	subject, err := c.CredentialSource.subjectToken(ctx)
+	if err != nil {
+		return tokenResp{}, err
+	}
+	form := url.Values{
+		"grant_type":           {tokenExchangeGrant},
+		"audience":             {c.Audience},
+		"scope":                {cloudPlatformScope},
+		"requested_token_type": {accessTokenType},
+		"subject_token":        {subject},
+		"subject_token_type":   {c.SubjectTokenType},
+	}
+	tr, err := fetchToken(ctx, "sts token", func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil || c.ServiceAccountImpersonationURL == "" {
+		return tr, err
+	}
+	return impersonate(ctx, StaticToken(tr.AccessToken), c.ServiceAccountImpersonationURL)
+}
+
+// subjectToken reads the token from the configured file or URL.
+func (cs *credentialSource) subjectToken(ctx context.Context) (string, error) {
+	var b []byte
+	switch {
+	case cs.File != "":
+		var err error
+		if b, err = os.ReadFile(cs.File); err != nil {
+			return "", fmt.Errorf("credentials: subject token: %w", err)
+		}
+	case cs.URL != "":
+		err := doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+			cctx, cancel := context.WithTimeout(parent, tokenTimeout())
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(cctx, http.MethodGet, cs.URL, nil)
+			if err != nil {
+				return err
+			}
+			for k, v := range cs.Headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return fmt.Errorf("subject token request: %w", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			if resp.StatusCode/100 != 2 {
+				if shouldRetryStatus(resp.StatusCode) {
+					return retryableStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+				}
+				return fmt.Errorf("subject token status=%d", resp.StatusCode)
+			}
+			b = body
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("credentials: %w", err)
+		}
+	default:
+		return "", errors.New("credentials: credential_source needs file or url")
+	}
+
+	if cs.Format.Type != "json" {
+		return strings.TrimSpace(string(b)), nil
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", fmt.Errorf("credentials: subject token json: %w", err)
+	}
+	tok, _ := m[cs.Format.SubjectTokenFieldName].(string)
+	if tok == "" {
+		return "", fmt.Errorf("credentials: subject token field %q missing", cs.Format.SubjectTokenFieldName)
+	}
+	return tok, nil
+}
+
+// impersonate calls IAM Credentials generateAccessToken at u with base's token.
+func impersonate(ctx context.Context, base TokenSource, u string) (tokenResp, error) {
+	body, err := json.Marshal(map[string]any{"scope": []string{cloudPlatformScope}, "lifetime": "3600s"})
+	if err != nil {
+		return tokenResp{}, err
+	}
+	var out struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	err = fetchJSON(ctx, "impersonation token", func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := setAuth(req, base); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}, &out)
+	if err != nil {
+		return tokenResp{}, err
+	}
+	if out.AccessToken == "" {
+		return tokenResp{}, errors.New("impersonation token missing accessToken")
+	}
+	expiresIn := int(time.Until(out.ExpireTime) / time.Second)
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	return tokenResp{AccessToken: out.AccessToken, ExpiresIn: expiresIn}, nil
+}
+
+// parseRSAKey decodes a PEM private key (PKCS#8, as in key files, or PKCS#1).
+func parseRSAKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("credentials: private_key is not PEM")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rk, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("credentials: private_key is not RSA")
+		}
+		return rk, nil
+	}
+	k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("credentials: private_key: %w", err)
+	}
+	return k, nil
+}
+
+// signJWT returns a compact RS256 JWS over claims.
+func signJWT(key *rsa.PrivateKey, kid string, claims map[string]any) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString(hb) + "." + enc.EncodeToString(cb)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("sign jwt: %w", err)
+	}
+	return signing + "." + enc.EncodeToString(sig), nil
+}
+
+// fetchToken performs an OAuth token request with the usual retry policy.
+// newReq builds a fresh request per attempt (bodies are consumed).
+func fetchToken(ctx context.Context, what string, newReq func(context.Context) (*http.Request, error)) (tokenResp, error) {
+	var tr tokenResp
+	if err := fetchJSON(ctx, what, newReq, &tr); err != nil {
+		return tokenResp{}, err
+	}
+	if tr.AccessToken == "" {
+		return tokenResp{}, fmt.Errorf("%s missing access_token", what)
+	}
+	return tr, nil
+}
+
+// fetchJSON performs a request with the usual retry policy and decodes the
+// JSON response into out.
+func fetchJSON(ctx context.Context, what string, newReq func(context.Context) (*http.Request, error), out any) error {
+	attempts := retries()
+	to := tokenTimeout()
+
+	err := doWithRetry(ctx, attempts, retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, to)
+		defer cancel()
+
+		req, err := newReq(cctx)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s request: %w", what, err)
+		}
+		defer resp.Body.Close()
+
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode/100 != 2 {
+			body := strings.TrimSpace(string(b))
+			if shouldRetryStatus(resp.StatusCode) {
+				return retryableStatusError{status: resp.StatusCode, body: body}
+			}
+			return fmt.Errorf("%s status=%d body=%s", what, resp.StatusCode, body)
+		}
+		if err := json.Unmarshal(b, out); err != nil {
+			return fmt.Errorf("%s parse: %w", what, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s failed after %d attempt(s): %w", what, attempts, err)
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package gcsutil
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeServiceAccountKey writes a key file for a fresh RSA key.
+func writeServiceAccountKey(t *testing.T, tokenURI string) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	b, _ := json.Marshal(credentialsFile{
+		Type:         "service_account",
+		ClientEmail:  "runner@proj.iam.gserviceaccount.com",
+		PrivateKeyID: "kid-1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     tokenURI,
+	})
+	p := filepath.Join(t.TempDir(), "key.json")
+	mustWrite(t, p, string(b))
+	return key, p
+}
+
+// verifyJWT checks an RS256 assertion against pub and returns its header and claims.
+func verifyJWT(t *testing.T, pub *rsa.PublicKey, jwt string) (map[string]any, map[string]any) {
+	t.Helper()
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("jwt has %d parts", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	var header, claims map[string]any
+	for i, v := range []*map[string]any{&header, &claims} {
+		b, _ := base64.RawURLEncoding.DecodeString(parts[i])
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("decode part %d: %v", i, err)
+		}
+	}
+	return header, claims
+}
+
+func TestAccessToken_ServiceAccountKey(t *testing.T) {
+	var key *rsa.PrivateKey
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // retried
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != jwtBearerGrant {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		header, claims := verifyJWT(t, &key.PublicKey, r.PostForm.Get("assertion"))
+		if header["alg"] != "RS256" || header["kid"] != "kid-1" {
+			t.Errorf("header=%v", header)
+		}
+		if claims["iss"] != "runner@proj.iam.gserviceaccount.com" || claims["aud"] != "http://"+r.Host+"/token" ||
+			claims["scope"] != cloudPlatformScope {
+			t.Errorf("claims=%v", claims)
+		}
+		_, _ = io.WriteString(w, `{"access_token":"sa-tok","expires_in":3599,"token_type":"Bearer"}`)
+	}))
+	defer srv.Close()
+
+	key, p := writeServiceAccountKey(t, "https://oauth2.invalid/token")
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("GCP_ACCESS_TOKEN", "")
+	t.Setenv("GCE_METADATA_HOST", "127.0.0.1:1") // must not be contacted
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", p)
+	t.Setenv("GCP_TOKEN_URL", srv.URL+"/token")
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+
+	tok, err := AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if tok != "sa-tok" || calls != 2 {
+		t.Fatalf("token=%q calls=%d", tok, calls)
+	}
+}
+
+func TestAccessToken_ServiceAccountRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"error":"invalid_grant"}`)
+	}))
+	defer srv.Close()
+
+	_, p := writeServiceAccountKey(t, srv.URL)
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("GCP_ACCESS_TOKEN", "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", p)
+	t.Setenv("GCP_TOKEN_URL", "")
+
+	_, err := AccessToken(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("err=%v want invalid_grant", err)
+	}
+}
+
+func TestCachedToken_RefreshesAheadOfExpiry(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	var mu sync.Mutex
+	var fetches int
+	fail := false
+	c := newCachedToken(func(context.Context) (tokenResp, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return tokenResp{}, errors.New("token endpoint down")
+		}
+		fetches++
+		return tokenResp{AccessToken: "tok-" + strconv.Itoa(fetches), ExpiresIn: 3600}, nil
+	})
+	c.now = func() time.Time { return now }
+
+	// Concurrent callers share one fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tok, err := c.Token(context.Background()); err != nil || tok != "tok-1" {
+				t.Errorf("token=%q err=%v", tok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Fatalf("fetches=%d want 1", fetches)
+	}
+
+	// Inside the refresh window a failed refresh keeps the still-valid token.
+	now = now.Add(56 * time.Minute)
+	fail = true
+	if tok, err := c.Token(context.Background()); err != nil || tok != "tok-1" {
+		t.Fatalf("token=%q err=%v want cached tok-1", tok, err)
+	}
+
+	// A working endpoint replaces the token before it expires.
+	fail = false
+	if tok, err := c.Token(context.Background()); err != nil || tok != "tok-2" {
+		t.Fatalf("token=%q err=%v want tok-2", tok, err)
+	}
+
+	// An expired token is never returned.
+	now = now.Add(2 * time.Hour)
+	fail = true
+	if _, err := c.Token(context.Background()); err == nil {
+		t.Fatalf("expected error once the token expired")
+	}
+}
+
+func TestGCSStore_UsesRefreshedTokenPerRequest(t *testing.T) {
+	fake := useFake(t)
+	now := time.Unix(1_700_000_000, 0)
+	n := 0
+	c := newCachedToken(func(context.Context) (tokenResp, error) {
+		n++
+		return tokenResp{AccessToken: "tok-" + strconv.Itoa(n), ExpiresIn: 600}, nil
+	})
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	s := NewGCSStore(c, "bkt")
+	fake.PutObject("bkt", "in/demo/left.csv", []byte("x"))
+
+	fake.Token = "tok-1"
+	if ok, err := s.Exists(ctx, "in/demo/left.csv"); err != nil || !ok {
+		t.Fatalf("Exists=%v err=%v", ok, err)
+	}
+	// Mid-run the old token expires; the next request must fetch a new one.
+	fake.Token = "tok-2"
+	now = now.Add(11 * time.Minute)
+	if ok, err := s.Exists(ctx, "in/demo/left.csv"); err != nil || !ok {
+		t.Fatalf("Exists after refresh=%v err=%v", ok, err)
+	}
+}
+
+// federationServer stands in for STS, IAM Credentials and an OIDC token URL.
+func federationServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = io.WriteString(w, `{"value":"oidc-subject"}`)
+	})
+	mux.HandleFunc("/sts", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		f := r.PostForm
+		if f.Get("grant_type") != tokenExchangeGrant || f.Get("requested_token_type") != accessTokenType ||
+			f.Get("audience") != "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/onprem" ||
+			f.Get("subject_token_type") != "urn:ietf:params:oauth:token-type:jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"error":"invalid_request"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"access_token":"federated-for-`+f.Get("subject_token")+`","expires_in":3600}`)
+	})
+	mux.HandleFunc("/iam/runner@proj.iam.gserviceaccount.com:generateAccessToken", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer federated-for-oidc-subject" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		_, _ = io.WriteString(w, `{"accessToken":"impersonated","expireTime":"`+exp+`"}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAccessToken_ExternalAccount(t *testing.T) {
+	srv := federationServer(t)
+	subjectFile := filepath.Join(t.TempDir(), "oidc.jwt")
+	mustWrite(t, subjectFile, "file-subject\n")
+
+	cases := []struct {
+		name   string
+		source string
+		imp    string
+		want   string
+	}{
+		{"file", `{"file":"` + filepath.ToSlash(subjectFile) + `"}`, "", "federated-for-file-subject"},
+		{"url json", `{"url":"` + srv.URL + `/oidc","headers":{"Metadata":"true"},"format":{"type":"json","subject_token_field_name":"value"}}`, "", "federated-for-oidc-subject"},
+		{"impersonated", `{"url":"` + srv.URL + `/oidc","headers":{"Metadata":"true"},"format":{"type":"json","subject_token_field_name":"value"}}`,
+			srv.URL + "/iam/runner@proj.iam.gserviceaccount.com:generateAccessToken", "impersonated"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cred := `{"type":"external_account",` +
+				`"audience":"//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/onprem",` +
+				`"subject_token_type":"urn:ietf:params:oauth:token-type:jwt",` +
+				`"token_url":"` + srv.URL + `/sts",` +
+				`"service_account_impersonation_url":"` + tc.imp + `",` +
+				`"credential_source":` + tc.source + `}`
+			p := filepath.Join(t.TempDir(), "external.json")
+			mustWrite(t, p, cred)
+
+			t.Setenv("STORAGE_EMULATOR_HOST", "")
+			t.Setenv("GCP_ACCESS_TOKEN", "")
+			t.Setenv("GCE_METADATA_HOST", "127.0.0.1:1") // must not be contacted
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", p)
+
+			tok, err := AccessToken(context.Background())
+			if err != nil {
+				t.Fatalf("AccessToken: %v", err)
+			}
+			if tok != tc.want {
+				t.Fatalf("token=%q want %q", tok, tc.want)
+			}
+		})
+	}
+}
+
+func TestImpersonatedTokenSource_PerIdentityExpiry(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	lifetimes := map[string]time.Duration{"in-sa@proj.iam.gserviceaccount.com": 10 * time.Minute,
+		"out-sa@client.iam.gserviceaccount.com": time.Hour}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer base-imp" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sa := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/-/serviceAccounts/"), ":generateAccessToken")
+		mu.Lock()
+		calls[sa]++
+		n := calls[sa]
+		mu.Unlock()
+		exp := time.Now().Add(lifetimes[sa]).UTC().Format(time.RFC3339)
+		_, _ = io.WriteString(w, `{"accessToken":"`+sa+`-`+strconv.Itoa(n)+`","expireTime":"`+exp+`"}`)
+	}))
+	defer srv.Close()
+	t.Setenv("IAM_CREDENTIALS_URL", srv.URL)
+
+	ctx := context.Background()
+	now := time.Now()
+	in := newImpersonatedToken(StaticToken("base-imp"), "in-sa@proj.iam.gserviceaccount.com")
+	out := newImpersonatedToken(StaticToken("base-imp"), "out-sa@client.iam.gserviceaccount.com")
+	for _, c := range []*cachedToken{in, out} {
+		c.now = func() time.Time { return now }
+	}
+
+	for i := 0; i < 2; i++ {
+		if tok, err := in.Token(ctx); err != nil || tok != "in-sa@proj.iam.gserviceaccount.com-1" {
+			t.Fatalf("in token=%q err=%v", tok, err)
+		}
+		if tok, err := out.Token(ctx); err != nil || tok != "out-sa@client.iam.gserviceaccount.com-1" {
+			t.Fatalf("out token=%q err=%v", tok, err)
+		}
+	}
+
+	// Six minutes later only the short-lived input identity is refreshed.
+	now = now.Add(6 * time.Minute)
+	if tok, _ := in.Token(ctx); tok != "in-sa@proj.iam.gserviceaccount.com-2" {
+		t.Fatalf("in token=%q want refreshed", tok)
+	}
+	if tok, _ := out.Token(ctx); tok != "out-sa@client.iam.gserviceaccount.com-1" {
+		t.Fatalf("out token=%q want cached", tok)
+	}
+
+	// Shared sources are memoized per identity.
+	if ImpersonatedTokenSource(StaticToken("b"), "x@p.iam.gserviceaccount.com") != ImpersonatedTokenSource(StaticToken("b"), "x@p.iam.gserviceaccount.com") {
+		t.Fatalf("ImpersonatedTokenSource not shared")
+	}
+}
+
+func TestDefaultTokenSource_FollowsIAMCredentialsURL(t *testing.T) {
+	iam := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			_, _ = io.WriteString(w, `{"accessToken":"`+name+`","expireTime":"`+exp+`"}`)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	a, b := iam("from-a"), iam("from-b")
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("GCP_ACCESS_TOKEN", "base")
+	ctx := context.Background()
+	const sa = "x@p.iam.gserviceaccount.com"
+
+	for _, tc := range []struct{ url, want string }{{a.URL, "from-a"}, {b.URL, "from-b"}} {
+		t.Setenv("IAM_CREDENTIALS_URL", tc.url)
+		base, err := DefaultTokenSource()
+		if err != nil {
+			t.Fatalf("DefaultTokenSource: %v", err)
+		}
+		if tok, err := ImpersonatedTokenSource(base, sa).Token(ctx); err != nil || tok != tc.want {
+			t.Fatalf("IAM_CREDENTIALS_URL=%s: token=%q err=%v want %q", tc.url, tok, err, tc.want)
+		}
+	}
+
+	// Rebuilding the default source leaves no stale impersonated sources behind.
+	t.Setenv("GCP_ACCESS_TOKEN", "base-2")
+	if _, err := DefaultTokenSource(); err != nil {
+		t.Fatal(err)
+	}
+	impersonatedMu.Lock()
+	n := len(impersonated)
+	impersonatedMu.Unlock()
+	if n != 0 {
+		t.Fatalf("impersonated sources after rebuild=%d want 0", n)
+	}
+}
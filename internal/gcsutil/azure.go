@@ -0,0 +1,417 @@
+package gcsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Azure Blob Storage (env) ----
+//
+//   AZURE_STORAGE_ACCOUNT:   storage account name (required)
+//   AZURE_STORAGE_KEY:       base64 account key (Shared Key auth), or
+//   AZURE_STORAGE_SAS_TOKEN: SAS token query string (with or without leading '?')
+//   AZURE_STORAGE_ENDPOINT:  blob endpoint (default https://<account>.blob.core.windows.net;
+//                            e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite)
+//
+// Retries and timeouts share the GCS_* knobs above.
+
+const (
+	azureAPIVersion = "2021-08-06"
+	azureBlockSize  = 4 << 20
+)
+
+// AzureStore is an ObjectStore for a single Azure Blob container.
+type AzureStore struct {
+	Account   string
+	Container string
+	Endpoint  string // scheme://host[/path], no trailing slash
+	Key       []byte // decoded account key; nil when using SAS
+	SAS       url.Values
+	BlockSize int64 // Put Block chunk size (default 4MiB)
+
+	now func() time.Time
+}
+
+// NewAzureStoreFromEnv returns an AzureStore for container configured from AZURE_STORAGE_* env vars.
+func NewAzureStoreFromEnv(container string) (*AzureStore, error) {
+	s := &AzureStore{
+		Account:   strings.TrimSpace(os.Getenv("AZURE_STORAGE_ACCOUNT")),
+		Container: container,
+		Endpoint:  strings.TrimRight(strings.TrimSpace(os.Getenv("AZURE_STORAGE_ENDPOINT")), "/"),
+	}
+	if s.Account == "" {
+		return nil, fmt.Errorf("azure: AZURE_STORAGE_ACCOUNT is required")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", s.Account)
+	}
+
+	if k := strings.TrimSpace(os.Getenv("AZURE_STORAGE_KEY")); k != "" {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("azure: AZURE_STORAGE_KEY is not valid base64: %w", err)
+		}
+		s.Key = key
+		return s, nil
+	}
+	if sas := strings.TrimSpace(os.Getenv("AZURE_STORAGE_SAS_TOKEN")); sas != "" {
+		q, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("azure: AZURE_STORAGE_SAS_TOKEN: %w", err)
+		}
+		s.SAS = q
+		return s, nil
+	}
+	return nil, fmt.Errorf("azure: AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN is required")
+}
+
+func (s *AzureStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// newRequest builds an authenticated request for blob ("" addresses the container).
+func (s *AzureStore) newRequest(ctx context.Context, method, blob string, q url.Values, body io.Reader, size int64) (*http.Request, error) {
+	if q == nil {
+		q = url.Values{}
+	}
+	for k, vs := range s.SAS {
+		q[k] = vs
+	}
+
+	u := s.Endpoint + "/" + s3EscapePath(s.Container)
+	if blob != "" {
+		u += "/" + s3EscapePath(blob)
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-ms-date", s.clock().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	return req, nil
+}
+
+// authorize signs req with Shared Key when an account key is configured.
+// SAS requests carry their authorization in the query string.
+func (s *AzureStore) authorize(req *http.Request) {
+	if s.Key == nil {
+		return
+	}
+	m := hmac.New(sha256.New, s.Key)
+	m.Write([]byte(s.stringToSign(req)))
+	sig := base64.StdEncoding.EncodeToString(m.Sum(nil))
+	req.Header.Set("Authorization", "SharedKey "+s.Account+":"+sig)
+}
+
+// stringToSign is the Shared Key canonical form (service version 2015-02-21+).
+func (s *AzureStore) stringToSign(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	lines := []string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date (x-ms-date is used instead)
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}
+
+	var msHeaders []string
+	for k, v := range h {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + s.Account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(vs, ",")
+	}
+
+	return strings.Join(lines, "\n") + "\n" + strings.Join(append(msHeaders, resource), "\n")
+}
+
+func (s *AzureStore) do(req *http.Request) (*http.Response, error) {
+	s.authorize(req)
+	return http.DefaultClient.Do(req)
+}
+
+// azureStatusError classifies a non-2xx Blob service response.
+func azureStatusError(op string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	body := strings.TrimSpace(string(b))
+	if shouldRetryStatus(resp.StatusCode) {
+		return retryableStatusError{status: resp.StatusCode, body: body}
+	}
+	return fmt.Errorf("azure %s status=%d body=%s", op, resp.StatusCode, body)
+}
+
+func (s *AzureStore) Exists(ctx context.Context, blob string) (bool, error) {
+	exists := false
+	err := doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, downloadTimeout())
+		defer cancel()
+
+		req, err := s.newRequest(cctx, http.MethodHead, blob, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return fmt.Errorf("azure head request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			exists = false
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			return azureStatusError("head", resp)
+		}
+		exists = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (s *AzureStore) Get(ctx context.Context, blob, dst string) error {
+	return doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, downloadTimeout())
+		defer cancel()
+
+		req, err := s.newRequest(cctx, http.MethodGet, blob, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return fmt.Errorf("azure get request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", ErrNotFound, blob)
+		}
+		if resp.StatusCode/100 != 2 {
+			return azureStatusError("get", resp)
+		}
+		return writeFileAtomic(dst, resp.Body, nil)
+	})
+}
+
+// Put uploads src as a block blob: one Put Block per BlockSize chunk
+// (each retried independently), then a Put Block List to commit them.
+// An empty file commits an empty block list.
+func (s *AzureStore) Put(ctx context.Context, blob, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	blockSize := s.BlockSize
+	if blockSize <= 0 {
+		blockSize = azureBlockSize
+	}
+
+	var ids []string
+	for off, n := int64(0), 0; off < fi.Size(); n++ {
+		size := fi.Size() - off
+		if size > blockSize {
+			size = blockSize
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", n)))
+		ids = append(ids, id)
+
+		section := io.NewSectionReader(f, off, size)
+		err := doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+			cctx, cancel := context.WithTimeout(parent, uploadTimeout())
+			defer cancel()
+
+			if _, err := section.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			q := url.Values{"comp": {"block"}, "blockid": {id}}
+			req, err := s.newRequest(cctx, http.MethodPut, blob, q, io.NopCloser(section), size)
+			if err != nil {
+				return err
+			}
+			resp, err := s.do(req)
+			if err != nil {
+				return fmt.Errorf("azure put block request: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode/100 != 2 {
+				return azureStatusError("put block", resp)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		off += size
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	body := list.Bytes()
+
+	return doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, uploadTimeout())
+		defer cancel()
+
+		q := url.Values{"comp": {"blocklist"}}
+		req, err := s.newRequest(cctx, http.MethodPut, blob, q, bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/xml")
+		req.Header.Set("x-ms-blob-content-type", "application/octet-stream")
+		resp, err := s.do(req)
+		if err != nil {
+			return fmt.Errorf("azure put block list request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return azureStatusError("put block list", resp)
+		}
+		return nil
+	})
+}
+
+type azureListResult struct {
+	Blobs struct {
+		Blob []struct {
+			Name string `xml:"Name"`
+		} `xml:"Blob"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *AzureStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+
+		var page azureListResult
+		err := doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+			cctx, cancel := context.WithTimeout(parent, downloadTimeout())
+			defer cancel()
+
+			req, err := s.newRequest(cctx, http.MethodGet, "", q, nil, 0)
+			if err != nil {
+				return err
+			}
+			resp, err := s.do(req)
+			if err != nil {
+				return fmt.Errorf("azure list request: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode/100 != 2 {
+				return azureStatusError("list", resp)
+			}
+			page = azureListResult{}
+			if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+				return fmt.Errorf("azure list parse: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range page.Blobs.Blob {
+			names = append(names, b.Name)
+		}
+		if page.NextMarker == "" {
+			break
+		}
+		marker = page.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *AzureStore) Delete(ctx context.Context, blob string) error {
+	return doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, uploadTimeout())
+		defer cancel()
+
+		req, err := s.newRequest(cctx, http.MethodDelete, blob, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return fmt.Errorf("azure delete request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			return azureStatusError("delete", resp)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,267 @@
+package gcsutil
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var azureTestKey = base64.StdEncoding.EncodeToString([]byte("test-account-key"))
+
+func TestAzureStringToSign(t *testing.T) {
+	s := &AzureStore{Account: "acct", Container: "drop", Endpoint: "https://acct.blob.core.windows.net",
+		now: func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }}
+
+	req, err := s.newRequest(context.Background(), http.MethodPut, "in/demo/right.csv",
+		map[string][]string{"comp": {"block"}, "blockid": {"YmxvY2s="}}, strings.NewReader("abc"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"PUT", "", "", "3", "", "", "", "", "", "", "", "",
+		"x-ms-date:Fri, 02 Jan 2026 03:04:05 GMT",
+		"x-ms-version:" + azureAPIVersion,
+		"/acct/drop/in/demo/right.csv",
+		"blockid:YmxvY2s=",
+		"comp:block",
+	}, "\n")
+	if got := s.stringToSign(req); got != want {
+		t.Fatalf("stringToSign\n got=%q\nwant=%q", got, want)
+	}
+}
+
+// fakeBlob emulates the subset of the Blob REST API used by AzureStore for one
+// container ("drop" in account "acct", path-style like Azurite).
+type fakeBlob struct {
+	mu       sync.Mutex
+	store    *AzureStore // used to check Shared Key signatures
+	useSAS   bool
+	blobs    map[string][]byte
+	staged   map[string]map[string][]byte
+	failNext int
+}
+
+func (f *fakeBlob) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.useSAS {
+		if r.URL.Query().Get("sig") != "s3cr3t" || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else {
+		want := r.Header.Get("Authorization")
+		f.store.authorize(r)
+		if got := r.Header.Get("Authorization"); got == "" || got != want {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	if f.failNext > 0 {
+		f.failNext--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	path := strings.TrimPrefix(r.URL.Path, "/acct/drop")
+	blob := strings.TrimPrefix(path, "/")
+
+	switch {
+	case r.Method == http.MethodGet && q.Get("comp") == "list":
+		var names []string
+		for k := range f.blobs {
+			if strings.HasPrefix(k, q.Get("prefix")) {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		type item struct {
+			Name string `xml:"Name"`
+		}
+		var res struct {
+			XMLName xml.Name `xml:"EnumerationResults"`
+			Blobs   []item   `xml:"Blobs>Blob"`
+		}
+		for _, n := range names {
+			res.Blobs = append(res.Blobs, item{n})
+		}
+		_ = xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		b, _ := io.ReadAll(r.Body)
+		if f.staged[blob] == nil {
+			f.staged[blob] = map[string][]byte{}
+		}
+		f.staged[blob][q.Get("blockid")] = b
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var out []byte
+		for _, id := range list.Latest {
+			b, ok := f.staged[blob][id]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			out = append(out, b...)
+		}
+		f.blobs[blob] = out
+		delete(f.staged, blob)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		b, ok := f.blobs[blob]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(b)
+		}
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[blob]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.blobs, blob)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func setenvAzure(t *testing.T, kv map[string]string) {
+	t.Helper()
+	for _, k := range []string{"AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_ENDPOINT", "AZURE_STORAGE_KEY", "AZURE_STORAGE_SAS_TOKEN"} {
+		old, had := os.LookupEnv(k)
+		if v, ok := kv[k]; ok {
+			os.Setenv(k, v)
+		} else {
+			os.Unsetenv(k)
+		}
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func exerciseAzureStore(t *testing.T, s ObjectStore, fake *fakeBlob) {
+	t.Helper()
+	ctx := context.Background()
+
+	body := strings.Repeat("id,amount\n", 10)
+	src := filepath.Join(t.TempDir(), "right.csv")
+	mustWrite(t, src, body)
+
+	fake.failNext = 1
+	if err := s.Put(ctx, "in/demo/right.csv", src); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := string(fake.blobs["in/demo/right.csv"]); got != body {
+		t.Fatalf("stored blob=%q", got)
+	}
+
+	ok, err := s.Exists(ctx, "in/demo/right.csv")
+	if err != nil || !ok {
+		t.Fatalf("Exists=%v err=%v", ok, err)
+	}
+	ok, err = s.Exists(ctx, "in/demo/left.csv")
+	if err != nil || ok {
+		t.Fatalf("Exists(missing)=%v err=%v", ok, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dl.csv")
+	if err := s.Get(ctx, "in/demo/right.csv", dst); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != body {
+		t.Fatalf("Get content=%q", b)
+	}
+	if err := s.Get(ctx, "in/demo/left.csv", dst); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(missing) err=%v want ErrNotFound", err)
+	}
+
+	names, err := s.List(ctx, "in/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"in/demo/right.csv"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("List=%v want %v", names, want)
+	}
+
+	if err := s.Delete(ctx, "in/demo/right.csv"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "in/demo/right.csv"); err != nil {
+		t.Fatalf("Delete(missing): %v", err)
+	}
+}
+
+func TestAzureStore_SharedKey(t *testing.T) {
+	os.Setenv("GCS_RETRY_BACKOFF", "1ms")
+	defer os.Unsetenv("GCS_RETRY_BACKOFF")
+
+	fake := &fakeBlob{blobs: map[string][]byte{}, staged: map[string]map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	setenvAzure(t, map[string]string{
+		"AZURE_STORAGE_ACCOUNT":  "acct",
+		"AZURE_STORAGE_ENDPOINT": srv.URL + "/acct",
+		"AZURE_STORAGE_KEY":      azureTestKey,
+	})
+
+	s, err := OpenStore(context.Background(), "az://drop")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	az := s.(*AzureStore)
+	az.BlockSize = 16 // force several blocks
+	fake.store = az
+
+	exerciseAzureStore(t, s, fake)
+}
+
+func TestAzureStore_SAS(t *testing.T) {
+	os.Setenv("GCS_RETRY_BACKOFF", "1ms")
+	defer os.Unsetenv("GCS_RETRY_BACKOFF")
+
+	fake := &fakeBlob{useSAS: true, blobs: map[string][]byte{}, staged: map[string]map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	setenvAzure(t, map[string]string{
+		"AZURE_STORAGE_ACCOUNT":   "acct",
+		"AZURE_STORAGE_ENDPOINT":  srv.URL + "/acct",
+		"AZURE_STORAGE_SAS_TOKEN": "?sv=2021-08-06&sp=racwdl&sig=s3cr3t",
+	})
+
+	s, err := OpenStore(context.Background(), "az://drop")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	exerciseAzureStore(t, s, fake)
+}
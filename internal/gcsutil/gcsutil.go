@@ -1,13 +1,16 @@
 package gcsutil
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -17,11 +20,15 @@ import (
 	"time"
 )
 
-const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+const (
+	defaultStorageURL   = "https://storage.googleapis.com"
+	defaultMetadataHost = "metadata.google.internal"
+	metadataTokenPath   = "/computeMetadata/v1/instance/service-accounts/default/token"
+)
 
 type tokenResp struct {
 	AccessToken string `json:"access_token"`
-	// ExpiresIn   int    `json:"expires_in"` // not needed for MVP
+	ExpiresIn   int    `json:"expires_in"` // seconds; 0 means do not cache
 	// TokenType   string `json:"token_type"`
 }
 
@@ -37,9 +44,28 @@ type tokenResp struct {
 //   GCS_DOWNLOAD_TIMEOUT: object download timeout (default 60s)
 //   GCS_UPLOAD_TIMEOUT:   object upload timeout (default 60s)
 //
+// Upload concurrency
+//   GCS_UPLOAD_CONCURRENCY: parallel uploads per run directory (default 8).
+//                           Completion markers are always uploaded last.
+//
+// Resumable uploads
+//   GCS_RESUMABLE_THRESHOLD:  files of at least this many bytes use a resumable
+//                             session instead of a single request (default 8MiB)
+//   GCS_RESUMABLE_CHUNK_SIZE: bytes per session PUT, rounded down to a multiple
+//                             of 256KiB (default 8MiB)
+//
 // Backoff
 //   GCS_RETRY_BACKOFF:     initial backoff between attempts (default 200ms)
 //   GCS_RETRY_MAX_BACKOFF: maximum backoff (default 2s)
+//
+// Endpoints
+//   STORAGE_EMULATOR_HOST: storage API host ("host:port" or "http://host:port"),
+//                          e.g. fake-gcs-server. When set, no token is fetched or sent.
+//   GCE_METADATA_HOST:     metadata server host (default metadata.google.internal)
+//   GCP_TOKEN_URL:         OAuth token endpoint for key files (default: the key's
+//                          token_uri, else https://oauth2.googleapis.com/token)
+//   IAM_CREDENTIALS_URL:   IAM Credentials API for impersonation
+//                          (default https://iamcredentials.googleapis.com)
 
 func envInt(name string, def int) int {
 	v := strings.TrimSpace(os.Getenv(name))
@@ -73,10 +99,74 @@ func downloadTimeout() time.Duration { return envDuration("GCS_DOWNLOAD_TIMEOUT"
 
 func uploadTimeout() time.Duration { return envDuration("GCS_UPLOAD_TIMEOUT", 60*time.Second) }
 
+func uploadConcurrency() int {
+	n := envInt("GCS_UPLOAD_CONCURRENCY", 8)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func resumableThreshold() int64 { return int64(envInt("GCS_RESUMABLE_THRESHOLD", 8<<20)) }
+
+func resumableChunkSize() int64 {
+	const quantum = 256 << 10
+	n := int64(envInt("GCS_RESUMABLE_CHUNK_SIZE", 8<<20)) / quantum * quantum
+	if n < quantum {
+		n = quantum
+	}
+	return n
+}
+
 func retryBackoff() time.Duration { return envDuration("GCS_RETRY_BACKOFF", 200*time.Millisecond) }
 
 func retryMaxBackoff() time.Duration { return envDuration("GCS_RETRY_MAX_BACKOFF", 2*time.Second) }
 
+// storageEmulatorHost returns STORAGE_EMULATOR_HOST as a base URL, or "".
+func storageEmulatorHost() string {
+	v := strings.TrimRight(strings.TrimSpace(os.Getenv("STORAGE_EMULATOR_HOST")), "/")
+	if v == "" {
+		return ""
+	}
+	if !strings.Contains(v, "://") {
+		v = "http://" + v
+	}
+	return v
+}
+
+// storageURL returns the base URL for storage API requests.
+func storageURL() string {
+	if v := storageEmulatorHost(); v != "" {
+		return v
+	}
+	return defaultStorageURL
+}
+
+func metadataTokenURL() string {
+	host := strings.TrimSpace(os.Getenv("GCE_METADATA_HOST"))
+	if host == "" {
+		host = defaultMetadataHost
+	}
+	return "http://" + host + metadataTokenPath
+}
+
+// setAuth adds a bearer token from ts, fetched per request so a cached
+// token is refreshed before it expires. Emulator requests carry no token.
+func setAuth(req *http.Request, ts TokenSource) error {
+	if ts == nil {
+		return nil
+	}
+	token, err := ts.Token(req.Context())
+	if err != nil {
+		// Not %w: token fetches already retry on their own.
+		return fmt.Errorf("gcs auth: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
 func shouldRetryStatus(code int) bool {
 	if code == http.StatusTooManyRequests {
 		return true
@@ -148,7 +238,13 @@ func doWithRetry(ctx context.Context, attempts int, backoff, maxBackoff time.Dur
 			last = err
 
 			var se retryableStatusError
-			if errors.As(err, &se) {
+			var ie *IntegrityError
+			if errors.As(err, &ie) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// Corrupt or truncated transfer: try again.
+				if i == attempts-1 {
+					return err
+				}
+			} else if errors.As(err, &se) {
 				if !shouldRetryStatus(se.status) || i == attempts-1 {
 					return err
 				}
@@ -173,58 +269,89 @@ func doWithRetry(ctx context.Context, attempts int, backoff, maxBackoff time.Dur
 	return last
 }
 
-// AccessToken returns a bearer token for calling Google APIs.
-// Priority:
-//  1. env GCP_ACCESS_TOKEN (for local testing)
-//  2. Cloud Run / GCE metadata server token
+// AccessToken returns a bearer token for calling Google APIs from the shared
+// DefaultTokenSource. Priority:
+//  1. STORAGE_EMULATOR_HOST set: no token ("")
+//  2. env GCP_ACCESS_TOKEN (for local testing)
+//  3. GOOGLE_APPLICATION_CREDENTIALS: a service-account key (JWT exchange at
+//     GCP_TOKEN_URL / token_uri) or an external_account file (STS exchange,
+//     optionally impersonating a service account)
+//  4. Cloud Run / GCE metadata server token (GCE_METADATA_HOST)
 func AccessToken(ctx context.Context) (string, error) {
-	if v := strings.TrimSpace(os.Getenv("GCP_ACCESS_TOKEN")); v != "" {
-		return v, nil
+	ts, err := DefaultTokenSource()
+	if err != nil {
+		return "", err
 	}
+	return ts.Token(ctx)
+}
+
+func ObjectExists(ctx context.Context, ts TokenSource, bucket, object string) (bool, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s",
+		storageURL(),
+		url.PathEscape(bucket),
+		url.PathEscape(object),
+	)
 
 	attempts := retries()
-	to := tokenTimeout()
+	to := downloadTimeout()
 
-	var out string
+	exists := false
 	err := doWithRetry(ctx, attempts, retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
 		cctx, cancel := context.WithTimeout(parent, to)
 		defer cancel()
 
-		req, err := http.NewRequestWithContext(cctx, http.MethodGet, metadataTokenURL, nil)
+		req, err := http.NewRequestWithContext(cctx, http.MethodGet, u, nil)
 		if err != nil {
 			return err
 		}
-		req.Header.Set("Metadata-Flavor", "Google")
+		if err := setAuth(req, ts); err != nil {
+			return err
+		}
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return fmt.Errorf("metadata token request: %w", err)
+			return err
 		}
 		defer resp.Body.Close()
 
-		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		if resp.StatusCode/100 != 2 {
-			return retryableStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(b))}
+		// Not found is a clean, non-retryable answer.
+		if resp.StatusCode == http.StatusNotFound {
+			exists = false
+			return nil
 		}
 
-		var tr tokenResp
-		if err := json.Unmarshal(b, &tr); err != nil {
-			return fmt.Errorf("metadata token parse: %w", err)
-		}
-		if tr.AccessToken == "" {
-			return fmt.Errorf("metadata token missing access_token")
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<10))
+			// Retry transient failures.
+			return retryableStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(b))}
 		}
-		out = tr.AccessToken
+
+		exists = true
 		return nil
 	})
 	if err != nil {
-		return "", fmt.Errorf("metadata token failed after %d attempt(s): %w", attempts, err)
+		return false, err
 	}
-	return out, nil
+	return exists, nil
+}
+
+// ErrNotFound is returned (wrapped) when an object or object generation does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrPreconditionFailed is returned (wrapped) when a generation precondition
+// (ifGenerationMatch) does not hold.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+type objectResp struct {
+	Generation string    `json:"generation"`
+	Size       string    `json:"size"`
+	Updated    time.Time `json:"updated"`
 }
 
-func ObjectExists(ctx context.Context, token, bucket, object string) (bool, error) {
-	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s",
+// StatObject returns the live generation and size of an object.
+func StatObject(ctx context.Context, ts TokenSource, bucket, object string) (ObjectAttrs, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?fields=generation,size,updated",
+		storageURL(),
 		url.PathEscape(bucket),
 		url.PathEscape(object),
 	)
@@ -232,7 +359,7 @@ func ObjectExists(ctx context.Context, token, bucket, object string) (bool, erro
 	attempts := retries()
 	to := downloadTimeout()
 
-	exists := false
+	var attrs ObjectAttrs
 	err := doWithRetry(ctx, attempts, retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
 		cctx, cancel := context.WithTimeout(parent, to)
 		defer cancel()
@@ -241,40 +368,54 @@ func ObjectExists(ctx context.Context, token, bucket, object string) (bool, erro
 		if err != nil {
 			return err
 		}
-		req.Header.Set("Authorization", "Bearer "+token)
+		if err := setAuth(req, ts); err != nil {
+			return err
+		}
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return err
+			return fmt.Errorf("gcs stat request: %w", err)
 		}
 		defer resp.Body.Close()
 
-		// Not found is a clean, non-retryable answer.
 		if resp.StatusCode == http.StatusNotFound {
-			exists = false
-			return nil
+			return fmt.Errorf("%w: %s", ErrNotFound, object)
 		}
-
-		if resp.StatusCode != http.StatusOK {
-			b, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<10))
-			// Retry transient failures.
-			return retryableStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(b))}
+		if resp.StatusCode/100 != 2 {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			body := strings.TrimSpace(string(b))
+			if shouldRetryStatus(resp.StatusCode) {
+				return retryableStatusError{status: resp.StatusCode, body: body}
+			}
+			return fmt.Errorf("gcs stat status=%d body=%s", resp.StatusCode, body)
 		}
 
-		exists = true
+		var or objectResp
+		if err := json.NewDecoder(resp.Body).Decode(&or); err != nil {
+			return fmt.Errorf("gcs stat parse: %w", err)
+		}
+		size, _ := strconv.ParseInt(or.Size, 10, 64)
+		attrs = ObjectAttrs{Generation: or.Generation, Size: size, Updated: or.Updated}
 		return nil
 	})
-	if err != nil {
-		return false, err
-	}
-	return exists, nil
+	return attrs, err
+}
+
+func DownloadToFile(ctx context.Context, ts TokenSource, bucket, object, dst string) error {
+	return DownloadGeneration(ctx, ts, bucket, object, "", dst)
 }
 
-func DownloadToFile(ctx context.Context, token, bucket, object, dst string) error {
-	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+// DownloadGeneration downloads a specific object generation ("" means live).
+// A missing object or generation yields an error wrapping ErrNotFound.
+func DownloadGeneration(ctx context.Context, ts TokenSource, bucket, object, generation, dst string) error {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media",
+		storageURL(),
 		url.PathEscape(bucket),
 		url.PathEscape(object),
 	)
+	if generation != "" {
+		u += "&generation=" + url.QueryEscape(generation)
+	}
 
 	attempts := retries()
 	to := downloadTimeout()
@@ -287,7 +428,9 @@ func DownloadToFile(ctx context.Context, token, bucket, object, dst string) erro
 		if err != nil {
 			return err
 		}
-		req.Header.Set("Authorization", "Bearer "+token)
+		if err := setAuth(req, ts); err != nil {
+			return err
+		}
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
@@ -295,6 +438,9 @@ func DownloadToFile(ctx context.Context, token, bucket, object, dst string) erro
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s (generation %q)", ErrNotFound, object, generation)
+		}
 		if resp.StatusCode/100 != 2 {
 			b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
 			body := strings.TrimSpace(string(b))
@@ -304,39 +450,489 @@ func DownloadToFile(ctx context.Context, token, bucket, object, dst string) erro
 			return fmt.Errorf("gcs download status=%d body=%s", resp.StatusCode, body)
 		}
 
-		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		// Verify the bytes against x-goog-hash before the file becomes visible.
+		// Transparently decompressed bodies no longer match the stored digests.
+		h := newHasher()
+		return writeFileAtomic(dst, io.TeeReader(resp.Body, h), func() error {
+			if resp.Uncompressed {
+				return nil
+			}
+			return verifyGoogHash(object, resp.Header, h.Sum())
+		})
+	})
+}
+
+// writeFileAtomic writes r to dst via temp + rename (atomic) to avoid partial
+// files on retry / crash. If check is non-nil it runs after the copy and a
+// non-nil result discards the temp file.
+func writeFileAtomic(dst string, r io.Reader, check func() error) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(f, r)
+	closeErr := f.Close()
+	if copyErr != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("download copy: %w", copyErr)
+	}
+	if closeErr != nil {
+		_ = os.Remove(tmp)
+		return closeErr
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			_ = os.Remove(tmp)
 			return err
 		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// uploadMetadata is the object resource sent with uploads. The digests make
+// GCS reject the upload if the bytes it received differ from the local file.
+type uploadMetadata struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	CRC32C      string `json:"crc32c"`
+	MD5Hash     string `json:"md5Hash"`
+}
+
+func UploadFile(ctx context.Context, ts TokenSource, bucket, object, src string) error {
+	sum, err := FileHashes(src)
+	if err != nil {
+		return err
+	}
+	meta := uploadMetadata{
+		Name:        object,
+		ContentType: "application/octet-stream",
+		CRC32C:      sum.CRC32C,
+		MD5Hash:     sum.MD5,
+	}
+	if sum.Size > 0 && sum.Size >= resumableThreshold() {
+		// A digest mismatch fails the whole session and a stalled session
+		// never finishes, so start a new one.
+		for i := 0; ; i++ {
+			err := uploadResumable(ctx, ts, bucket, object, src, sum.Size, meta)
+			var ie *IntegrityError
+			if (errors.As(err, &ie) || errors.Is(err, errResumableStalled)) && i < retries()-1 {
+				continue
+			}
+			return err
+		}
+	}
+
+	_, err = uploadMultipart(ctx, ts, bucket, src, sum.Size, meta, nil)
+	return err
+}
+
+// UploadFileIfGeneration uploads src only if the live generation of object is
+// ifGeneration ("0" means the object must not exist) and returns the new
+// generation. A failed precondition yields an error wrapping
+// ErrPreconditionFailed. It always uses a single request, so it suits small
+// objects such as claims.
+func UploadFileIfGeneration(ctx context.Context, ts TokenSource, bucket, object, src, ifGeneration string) (string, error) {
+	sum, err := FileHashes(src)
+	if err != nil {
+		return "", err
+	}
+	meta := uploadMetadata{
+		Name:        object,
+		ContentType: "application/octet-stream",
+		CRC32C:      sum.CRC32C,
+		MD5Hash:     sum.MD5,
+	}
+	return uploadMultipart(ctx, ts, bucket, src, sum.Size, meta, url.Values{"ifGenerationMatch": {ifGeneration}})
+}
 
-		// Write to temp + rename (atomic) to avoid partial files on retry / crash.
-		tmp := dst + ".tmp"
-		f, err := os.Create(tmp)
+// uploadMultipart uploads src in one multipart/related request (JSON metadata
+// part, then the file as the media part) and returns the new generation.
+func uploadMultipart(ctx context.Context, ts TokenSource, bucket, src string, size int64, meta uploadMetadata, conds url.Values) (string, error) {
+	object := meta.Name
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=multipart",
+		storageURL(),
+		url.PathEscape(bucket),
+	)
+	if len(conds) > 0 {
+		u += "&" + conds.Encode()
+	}
+
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	mh := textproto.MIMEHeader{}
+	mh.Set("Content-Type", "application/json; charset=UTF-8")
+	pw, err := mw.CreatePart(mh)
+	if err != nil {
+		return "", err
+	}
+	if err := json.NewEncoder(pw).Encode(meta); err != nil {
+		return "", err
+	}
+	mh = textproto.MIMEHeader{}
+	mh.Set("Content-Type", meta.ContentType)
+	if _, err := mw.CreatePart(mh); err != nil {
+		return "", err
+	}
+	prefix := append([]byte(nil), head.Bytes()...)
+	head.Reset()
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	suffix := head.Bytes()
+	contentType := "multipart/related; boundary=" + mw.Boundary()
+
+	attempts := retries()
+	to := uploadTimeout()
+
+	var generation string
+	err = doWithRetry(ctx, attempts, retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, to)
+		defer cancel()
+
+		f, err := os.Open(src)
 		if err != nil {
 			return err
 		}
-		_, copyErr := io.Copy(f, resp.Body)
-		closeErr := f.Close()
-		if copyErr != nil {
-			_ = os.Remove(tmp)
-			return fmt.Errorf("download copy: %w", copyErr)
+		defer f.Close()
+
+		body := io.MultiReader(bytes.NewReader(prefix), f, bytes.NewReader(suffix))
+		req, err := http.NewRequestWithContext(cctx, http.MethodPost, u, body)
+		if err != nil {
+			return err
 		}
-		if closeErr != nil {
-			_ = os.Remove(tmp)
-			return closeErr
+		if err := setAuth(req, ts); err != nil {
+			return err
 		}
-		if err := os.Rename(tmp, dst); err != nil {
-			_ = os.Remove(tmp)
+		req.ContentLength = int64(len(prefix)) + size + int64(len(suffix))
+		req.Header.Set("Content-Type", contentType)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("gcs upload request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return uploadStatusError(object, "upload", resp)
+		}
+		var or objectResp
+		_ = json.NewDecoder(resp.Body).Decode(&or)
+		generation = or.Generation
+		return nil
+	})
+	return generation, err
+}
+
+// uploadResumable uploads src through a resumable session: the file is sent in
+// chunks, each with its own retry budget. After a failed chunk the session is
+// queried for the persisted offset, so only the missing bytes are re-sent.
+// errResumableStalled means a session answered 308 without persisting more
+// bytes. UploadFile starts a new session rather than resending forever.
+var errResumableStalled = errors.New("resumable session made no progress")
+
+func uploadResumable(ctx context.Context, ts TokenSource, bucket, object, src string, size int64, meta uploadMetadata) error {
+	session, err := startResumable(ctx, ts, bucket, size, meta)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	attempts := retries()
+	to := uploadTimeout()
+	chunk := resumableChunkSize()
+
+	var offset int64
+	resync := false
+	for {
+		prev := offset
+		done := false
+		var rejected error
+		err := doWithRetry(ctx, attempts, retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+			cctx, cancel := context.WithTimeout(parent, to)
+			defer cancel()
+
+			if resync {
+				off, fin, err := resumableStatus(cctx, ts, session, object, size)
+				if err != nil {
+					return err
+				}
+				offset, done, resync = off, fin, false
+				if done {
+					return nil
+				}
+			}
+
+			off, fin, err := resumablePut(cctx, ts, session, object, f, offset, chunk, size)
+			if err != nil {
+				var ie *IntegrityError
+				if errors.As(err, &ie) {
+					// Finalization failed the digest check; the session is gone.
+					rejected = err
+					return nil
+				}
+				resync = true
+				return err
+			}
+			offset, done = off, fin
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("gcs resumable upload %s at offset %d: %w", object, offset, err)
+		}
+		if rejected != nil {
+			return rejected
+		}
+		if done {
+			return nil
+		}
+		if offset <= prev {
+			return fmt.Errorf("gcs resumable upload %s at offset %d: %w", object, offset, errResumableStalled)
+		}
+	}
+}
+
+// startResumable initiates a session and returns its URI.
+func startResumable(ctx context.Context, ts TokenSource, bucket string, size int64, meta uploadMetadata) (string, error) {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable",
+		storageURL(),
+		url.PathEscape(bucket),
+	)
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	var session string
+	err = doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, uploadTimeout())
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(cctx, http.MethodPost, u, bytes.NewReader(metaJSON))
+		if err != nil {
 			return err
 		}
+		if err := setAuth(req, ts); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", meta.ContentType)
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("gcs resumable start request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return uploadStatusError(meta.Name, "resumable start", resp)
+		}
+		session = resp.Header.Get("Location")
+		if session == "" {
+			return fmt.Errorf("gcs resumable start: missing Location header")
+		}
 		return nil
 	})
+	return session, err
+}
+
+// resumablePut sends the chunk starting at offset and returns the new
+// persisted offset and whether the upload is complete.
+func resumablePut(ctx context.Context, ts TokenSource, session, object string, f *os.File, offset, chunk, size int64) (int64, bool, error) {
+	end := offset + chunk
+	if end > size {
+		end = size
+	}
+	body := io.NewSectionReader(f, offset, end-offset)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, body)
+	if err != nil {
+		return offset, false, err
+	}
+	if err := setAuth(req, ts); err != nil {
+		return offset, false, err
+	}
+	req.ContentLength = end - offset
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return offset, false, fmt.Errorf("gcs resumable put request: %w", err)
+	}
+	defer resp.Body.Close()
+	return resumableResult(resp, object, offset, size)
+}
+
+// resumableStatus asks the session how many bytes it has persisted.
+func resumableStatus(ctx context.Context, ts TokenSource, session, object string, size int64) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := setAuth(req, ts); err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("gcs resumable status request: %w", err)
+	}
+	defer resp.Body.Close()
+	return resumableResult(resp, object, 0, size)
+}
+
+// resumableResult interprets a session response: 2xx means complete, 308
+// carries the persisted range ("bytes=0-N"; absent means nothing persisted).
+func resumableResult(resp *http.Response, object string, offset, size int64) (int64, bool, error) {
+	switch {
+	case resp.StatusCode/100 == 2:
+		return size, true, nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return 0, false, nil
+		}
+		_, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+		n, err := strconv.ParseInt(last, 10, 64)
+		if !ok || err != nil {
+			return offset, false, fmt.Errorf("gcs resumable: bad Range header %q", r)
+		}
+		return n + 1, false, nil
+	default:
+		return offset, false, uploadStatusError(object, "resumable put", resp)
+	}
+}
+
+// uploadStatusError classifies a non-2xx upload response. A 400 naming one of
+// our digests means GCS received different bytes than we sent.
+func uploadStatusError(object, op string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	body := strings.TrimSpace(string(b))
+	if resp.StatusCode == http.StatusBadRequest {
+		lb := strings.ToLower(body)
+		if strings.Contains(lb, "crc32c") || strings.Contains(lb, "md5") {
+			return &IntegrityError{Object: object, Algo: "upload digest rejected: " + body}
+		}
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w: %s", ErrPreconditionFailed, object)
+	}
+	if shouldRetryStatus(resp.StatusCode) {
+		return retryableStatusError{status: resp.StatusCode, body: body}
+	}
+	return fmt.Errorf("gcs %s status=%d body=%s", op, resp.StatusCode, body)
+}
+
+type listResp struct {
+	Items []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
 }
 
-func UploadFile(ctx context.Context, token, bucket, object, src string) error {
-	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+// ListObjects returns the names of all objects under prefix, sorted.
+func ListObjects(ctx context.Context, ts TokenSource, bucket, prefix string) ([]string, error) {
+	attempts := retries()
+	to := downloadTimeout()
+
+	var names []string
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", prefix)
+		q.Set("fields", "items(name),nextPageToken")
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s",
+			storageURL(),
+			url.PathEscape(bucket),
+			q.Encode(),
+		)
+
+		var page listResp
+		err := doWithRetry(ctx, attempts, retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+			cctx, cancel := context.WithTimeout(parent, to)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(cctx, http.MethodGet, u, nil)
+			if err != nil {
+				return err
+			}
+			if err := setAuth(req, ts); err != nil {
+				return err
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return fmt.Errorf("gcs list request: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode/100 != 2 {
+				b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+				body := strings.TrimSpace(string(b))
+				if shouldRetryStatus(resp.StatusCode) {
+					return retryableStatusError{status: resp.StatusCode, body: body}
+				}
+				return fmt.Errorf("gcs list status=%d body=%s", resp.StatusCode, body)
+			}
+
+			page = listResp{}
+			if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+				return fmt.Errorf("gcs list parse: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, it := range page.Items {
+			names = append(names, it.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteObject removes an object. A missing object is not an error.
+func DeleteObject(ctx context.Context, ts TokenSource, bucket, object string) error {
+	return DeleteObjectIfGeneration(ctx, ts, bucket, object, "")
+}
+
+// DeleteObjectIfGeneration removes an object only if its live generation is
+// ifGeneration ("" means unconditionally). A failed precondition yields an
+// error wrapping ErrPreconditionFailed; a missing object is not an error.
+func DeleteObjectIfGeneration(ctx context.Context, ts TokenSource, bucket, object, ifGeneration string) error {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s",
+		storageURL(),
 		url.PathEscape(bucket),
-		url.QueryEscape(object),
+		url.PathEscape(object),
 	)
+	if ifGeneration != "" {
+		u += "?ifGenerationMatch=" + url.QueryEscape(ifGeneration)
+	}
 
 	attempts := retries()
 	to := uploadTimeout()
@@ -345,34 +941,34 @@ func UploadFile(ctx context.Context, token, bucket, object, src string) error {
 		cctx, cancel := context.WithTimeout(parent, to)
 		defer cancel()
 
-		f, err := os.Open(src)
+		req, err := http.NewRequestWithContext(cctx, http.MethodDelete, u, nil)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-
-		req, err := http.NewRequestWithContext(cctx, http.MethodPost, u, f)
-		if err != nil {
+		if err := setAuth(req, ts); err != nil {
 			return err
 		}
-		req.Header.Set("Authorization", "Bearer "+token)
-		req.Header.Set("Content-Type", "application/octet-stream")
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return fmt.Errorf("gcs upload request: %w", err)
+			return fmt.Errorf("gcs delete request: %w", err)
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			return fmt.Errorf("%w: %s", ErrPreconditionFailed, object)
+		}
 		if resp.StatusCode/100 != 2 {
 			b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
 			body := strings.TrimSpace(string(b))
 			if shouldRetryStatus(resp.StatusCode) {
 				return retryableStatusError{status: resp.StatusCode, body: body}
 			}
-			return fmt.Errorf("gcs upload status=%d body=%s", resp.StatusCode, body)
+			return fmt.Errorf("gcs delete status=%d body=%s", resp.StatusCode, body)
 		}
-
 		return nil
 	})
 }
@@ -404,8 +1000,7 @@ func collectFilePaths(dir string) ([]string, error) {
 	var markers []string
 	var rest []string
 	for _, p := range files {
-		base := filepath.Base(p)
-		if base == "_SUCCESS.json" || base == "_ERROR.json" {
+		if isMarker(p) {
 			markers = append(markers, p)
 			continue
 		}
@@ -415,20 +1010,6 @@ func collectFilePaths(dir string) ([]string, error) {
 	return files, nil
 }
 
-func UploadDir(ctx context.Context, token, bucket, prefix, dir string) error {
-	files, err := collectFilePaths(dir)
-	if err != nil {
-		return err
-	}
-	for _, p := range files {
-		rel, err := filepath.Rel(dir, p)
-		if err != nil {
-			return err
-		}
-		obj := filepath.ToSlash(filepath.Join(prefix, rel))
-		if err := UploadFile(ctx, token, bucket, obj, p); err != nil {
-			return err
-		}
-	}
-	return nil
+func UploadDir(ctx context.Context, ts TokenSource, bucket, prefix, dir string) error {
+	return PutDir(ctx, NewGCSStore(ts, bucket), prefix, dir)
 }
@@ -2,13 +2,17 @@ package gcsutil
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsfake"
 )
 
 func mustWrite(t *testing.T, path, body string) {
@@ -75,8 +79,7 @@ func TestObjectExists(t *testing.T) {
 	defer func() { http.DefaultClient.Transport = old }()
 
 	// Ensure deterministic retry behavior in this unit test.
-	os.Setenv("GCS_RETRIES", "1")
-	defer os.Unsetenv("GCS_RETRIES")
+	t.Setenv("GCS_RETRIES", "1")
 
 	http.DefaultClient.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
 		if req.Method != http.MethodGet {
@@ -119,7 +122,7 @@ func TestObjectExists(t *testing.T) {
 
 	ctx := context.Background()
 
-	ok, err := ObjectExists(ctx, "tok", "bucket", "exist")
+	ok, err := ObjectExists(ctx, StaticToken("tok"), "bucket", "exist")
 	if err != nil {
 		t.Fatalf("ObjectExists exist: %v", err)
 	}
@@ -127,7 +130,7 @@ func TestObjectExists(t *testing.T) {
 		t.Fatalf("expected exist=true")
 	}
 
-	ok, err = ObjectExists(ctx, "tok", "bucket", "nope")
+	ok, err = ObjectExists(ctx, StaticToken("tok"), "bucket", "nope")
 	if err != nil {
 		t.Fatalf("ObjectExists nope: %v", err)
 	}
@@ -135,3 +138,240 @@ func TestObjectExists(t *testing.T) {
 		t.Fatalf("expected exist=false")
 	}
 }
+
+func useFake(t *testing.T) *gcsfake.Server {
+	t.Helper()
+	fake := gcsfake.New()
+	fake.Token = "tok"
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = fake.Transport()
+	t.Cleanup(func() {
+		http.DefaultClient.Transport = old
+		fake.Close()
+	})
+	return fake
+}
+
+func TestUploadDownload_Fake(t *testing.T) {
+	fake := useFake(t)
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+
+	ctx := context.Background()
+	src := filepath.Join(t.TempDir(), "left.csv")
+	mustWrite(t, src, "id,amount\na1,10.00\n")
+
+	fake.AddFault(gcsfake.Fault{Method: http.MethodPost, Status: http.StatusServiceUnavailable})
+	if err := UploadFile(ctx, StaticToken("tok"), "bkt", "in/demo/left.csv", src); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if b, ok := fake.Object("bkt", "in/demo/left.csv"); !ok || string(b) != "id,amount\na1,10.00\n" {
+		t.Fatalf("stored object=%q ok=%v", b, ok)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dl", "left.csv")
+	fake.AddFault(gcsfake.Fault{Object: "in/demo/left.csv", Status: http.StatusTooManyRequests})
+	if err := DownloadToFile(ctx, StaticToken("tok"), "bkt", "in/demo/left.csv", dst); err != nil {
+		t.Fatalf("DownloadToFile: %v", err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "id,amount\na1,10.00\n" {
+		t.Fatalf("downloaded=%q", b)
+	}
+
+	names, err := ListObjects(ctx, StaticToken("tok"), "bkt", "in/")
+	if err != nil {
+		t.Fatalf("ListObjects: %v", err)
+	}
+	if want := []string{"in/demo/left.csv"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("ListObjects=%v want %v", names, want)
+	}
+
+	if err := DeleteObject(ctx, StaticToken("tok"), "bkt", "in/demo/left.csv"); err != nil {
+		t.Fatalf("DeleteObject: %v", err)
+	}
+	if err := DeleteObject(ctx, StaticToken("tok"), "bkt", "in/demo/left.csv"); err != nil {
+		t.Fatalf("DeleteObject(missing): %v", err)
+	}
+}
+
+func TestDownloadToFile_TruncatedLeavesNoFile(t *testing.T) {
+	fake := useFake(t)
+	t.Setenv("GCS_RETRIES", "1")
+
+	fake.PutObject("bkt", "in/demo/right.csv", []byte("id,amount\na1,10.00\na2,20.00\n"))
+	fake.AddFault(gcsfake.Fault{Object: "in/demo/right.csv", Truncate: 5})
+
+	dst := filepath.Join(t.TempDir(), "right.csv")
+	if err := DownloadToFile(context.Background(), StaticToken("tok"), "bkt", "in/demo/right.csv", dst); err == nil {
+		t.Fatalf("expected error on truncated body")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("expected no partial file, stat err=%v", err)
+	}
+}
+
+func TestStorageEmulatorHost_SkipsAuth(t *testing.T) {
+	fake := gcsfake.New() // no Token: any Authorization header is accepted
+	defer fake.Close()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(fake.URL(), "http://"))
+	t.Setenv("GCE_METADATA_HOST", "127.0.0.1:1") // must not be contacted
+
+	ctx := context.Background()
+	s, err := OpenStore(ctx, "gs://bkt")
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if tok, _ := s.(*GCSStore).Tokens.Token(ctx); tok != "" {
+		t.Fatalf("expected no token with emulator, got %q", tok)
+	}
+
+	fake.PutObject("bkt", "in/demo/right.csv", []byte("x"))
+	ok, err := s.Exists(ctx, "in/demo/right.csv")
+	if err != nil || !ok {
+		t.Fatalf("Exists=%v err=%v", ok, err)
+	}
+}
+
+func TestAccessToken_MetadataHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != metadataTokenPath {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = io.WriteString(w, `{"access_token":"meta-tok","expires_in":3599,"token_type":"Bearer"}`)
+	}))
+	defer srv.Close()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("GCP_ACCESS_TOKEN", "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	tok, err := AccessToken(context.Background())
+	if err != nil {
+		t.Fatalf("AccessToken: %v", err)
+	}
+	if tok != "meta-tok" {
+		t.Fatalf("token=%q", tok)
+	}
+}
+
+func TestUploadFile_ResumableResumesAfterFailure(t *testing.T) {
+	fake := useFake(t)
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+	t.Setenv("GCS_RESUMABLE_THRESHOLD", "1")
+	t.Setenv("GCS_RESUMABLE_CHUNK_SIZE", "262144")
+
+	data := []byte(strings.Repeat("0123456789abcdef", 40000)) // 640000 bytes: 3 chunks
+	src := filepath.Join(t.TempDir(), "pack.bin")
+	mustWrite(t, src, string(data))
+
+	// Fail the second chunk once; the client must query the session and resend it.
+	fake.AddFault(gcsfake.Fault{Method: http.MethodPut, Status: http.StatusServiceUnavailable, After: 1})
+
+	if err := UploadFile(context.Background(), StaticToken("tok"), "bkt", "out/demo/pack.bin", src); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	got, ok := fake.Object("bkt", "out/demo/pack.bin")
+	if !ok || string(got) != string(data) {
+		t.Fatalf("stored %d bytes ok=%v, want %d", len(got), ok, len(data))
+	}
+
+	// chunk1, (failed chunk2 is not logged), status query, chunk2, chunk3
+	var chunks int
+	for _, l := range fake.Log() {
+		if l == "upload-chunk bkt/out/demo/pack.bin" {
+			chunks++
+		}
+	}
+	if chunks != 4 {
+		t.Fatalf("session requests=%d want 4; log=%v", chunks, fake.Log())
+	}
+}
+
+func TestUploadFile_ResumableRestartsStalledSession(t *testing.T) {
+	fake := useFake(t)
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+	t.Setenv("GCS_RESUMABLE_THRESHOLD", "1")
+	t.Setenv("GCS_RESUMABLE_CHUNK_SIZE", "262144")
+	ctx := context.Background()
+
+	data := []byte(strings.Repeat("0123456789abcdef", 40000)) // 640000 bytes: 3 chunks
+	src := filepath.Join(t.TempDir(), "pack.bin")
+	mustWrite(t, src, string(data))
+
+	// The second chunk is answered with 308 at the old offset: a new session finishes the upload.
+	fake.AddFault(gcsfake.Fault{Method: http.MethodPut, Stall: true, After: 1})
+	if err := UploadFile(ctx, StaticToken("tok"), "bkt", "out/demo/pack.bin", src); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	got, ok := fake.Object("bkt", "out/demo/pack.bin")
+	if !ok || string(got) != string(data) {
+		t.Fatalf("stored %d bytes ok=%v, want %d", len(got), ok, len(data))
+	}
+
+	// A session that never advances fails fast instead of resending until the deadline.
+	t.Setenv("GCS_RETRIES", "2")
+	fake.AddFault(gcsfake.Fault{Method: http.MethodPut, Stall: true, Times: 100})
+	err := UploadFile(ctx, StaticToken("tok"), "bkt", "out/demo/stuck.bin", src)
+	if !errors.Is(err, errResumableStalled) {
+		t.Fatalf("err=%v want errResumableStalled", err)
+	}
+	if _, ok := fake.Object("bkt", "out/demo/stuck.bin"); ok {
+		t.Fatal("stalled upload created the object")
+	}
+}
+
+func TestIntegrity_DownloadAndUpload(t *testing.T) {
+	fake := useFake(t)
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+	ctx := context.Background()
+
+	data := "id,amount\na1,10.00\n"
+	fake.PutObject("bkt", "in/demo/left.csv", []byte(data))
+
+	// A corrupted body is detected via x-goog-hash and retried.
+	fake.AddFault(gcsfake.Fault{Object: "in/demo/left.csv", Corrupt: true})
+	dst := filepath.Join(t.TempDir(), "left.csv")
+	if err := DownloadToFile(ctx, StaticToken("tok"), "bkt", "in/demo/left.csv", dst); err != nil {
+		t.Fatalf("DownloadToFile: %v", err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != data {
+		t.Fatalf("downloaded=%q", b)
+	}
+
+	// Without retries the mismatch surfaces as an IntegrityError and no file is left.
+	t.Setenv("GCS_RETRIES", "1")
+	fake.AddFault(gcsfake.Fault{Object: "in/demo/left.csv", Corrupt: true})
+	dst2 := filepath.Join(t.TempDir(), "left.csv")
+	err := DownloadToFile(ctx, StaticToken("tok"), "bkt", "in/demo/left.csv", dst2)
+	var ie *IntegrityError
+	if !errors.As(err, &ie) || ie.Algo != "crc32c" {
+		t.Fatalf("err=%v want crc32c IntegrityError", err)
+	}
+	if _, err := os.Stat(dst2); !os.IsNotExist(err) {
+		t.Fatalf("expected no file after integrity failure")
+	}
+
+	// Uploads carry digests; bytes corrupted in transit are rejected and re-sent.
+	t.Setenv("GCS_RETRIES", "3")
+	src := filepath.Join(t.TempDir(), "out.csv")
+	mustWrite(t, src, data)
+	fake.AddFault(gcsfake.Fault{Method: http.MethodPost, Corrupt: true})
+	if err := UploadFile(ctx, StaticToken("tok"), "bkt", "out/demo/out.csv", src); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if b, _ := fake.Object("bkt", "out/demo/out.csv"); string(b) != data {
+		t.Fatalf("stored=%q", b)
+	}
+
+	// Same for a resumable session: the failed session is replaced by a new one.
+	t.Setenv("GCS_RESUMABLE_THRESHOLD", "1")
+	fake.AddFault(gcsfake.Fault{Method: http.MethodPut, Corrupt: true})
+	if err := UploadFile(ctx, StaticToken("tok"), "bkt", "out/demo/big.csv", src); err != nil {
+		t.Fatalf("UploadFile resumable: %v", err)
+	}
+	if b, _ := fake.Object("bkt", "out/demo/big.csv"); string(b) != data {
+		t.Fatalf("stored=%q", b)
+	}
+}
@@ -0,0 +1,120 @@
+package gcsutil
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Hashes are content digests in the encodings GCS uses: CRC32C and MD5 are
+// base64 (CRC32C big-endian), SHA256 is lowercase hex.
+type Hashes struct {
+	Size   int64  `json:"size"`
+	CRC32C string `json:"crc32c"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// hasher computes Hashes over everything written to it.
+type hasher struct {
+	n      int64
+	crc    hash.Hash32
+	md5    hash.Hash
+	sha256 hash.Hash
+	w      io.Writer
+}
+
+func newHasher() *hasher {
+	h := &hasher{crc: crc32.New(castagnoli), md5: md5.New(), sha256: sha256.New()}
+	h.w = io.MultiWriter(h.crc, h.md5, h.sha256)
+	return h
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	h.n += int64(len(p))
+	return h.w.Write(p)
+}
+
+func (h *hasher) Sum() Hashes {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], h.crc.Sum32())
+	return Hashes{
+		Size:   h.n,
+		CRC32C: base64.StdEncoding.EncodeToString(crc[:]),
+		MD5:    base64.StdEncoding.EncodeToString(h.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(h.sha256.Sum(nil)),
+	}
+}
+
+// FileHashes returns the digests of a local file.
+func FileHashes(p string) (Hashes, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Hashes{}, err
+	}
+	defer f.Close()
+	h := newHasher()
+	if _, err := io.Copy(h, f); err != nil {
+		return Hashes{}, err
+	}
+	return h.Sum(), nil
+}
+
+// IntegrityError reports content that does not match the digest the storage
+// service advertised (or rejected as not matching ours). It is retryable.
+type IntegrityError struct {
+	Object string
+	Algo   string
+	Want   string
+	Got    string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Want == "" {
+		return fmt.Sprintf("integrity check failed for %s (%s)", e.Object, e.Algo)
+	}
+	return fmt.Sprintf("integrity check failed for %s: %s want=%s got=%s", e.Object, e.Algo, e.Want, e.Got)
+}
+
+// parseGoogHash parses x-goog-hash headers ("crc32c=...,md5=...", possibly repeated).
+func parseGoogHash(h http.Header) (crc, md5sum string) {
+	for _, v := range h.Values("X-Goog-Hash") {
+		for _, part := range strings.Split(v, ",") {
+			k, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok {
+				continue
+			}
+			switch k {
+			case "crc32c":
+				crc = val
+			case "md5":
+				md5sum = val
+			}
+		}
+	}
+	return crc, md5sum
+}
+
+// verifyGoogHash checks got against the digests advertised in h.
+// Composite objects carry no MD5, so only the digests present are compared.
+func verifyGoogHash(object string, h http.Header, got Hashes) error {
+	crc, md5sum := parseGoogHash(h)
+	if crc != "" && crc != got.CRC32C {
+		return &IntegrityError{Object: object, Algo: "crc32c", Want: crc, Got: got.CRC32C}
+	}
+	if md5sum != "" && md5sum != got.MD5 {
+		return &IntegrityError{Object: object, Algo: "md5", Want: md5sum, Got: got.MD5}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package gcsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStore is a directory-backed ObjectStore. Object names map to files
+// under Root, so a laptop or CI job can exercise the same flow as GCS.
+//
+// Generations are file modification times in nanoseconds. Conditional writes
+// are atomic across processes: a create hard-links a uniquely staged file (the
+// link fails if the object exists), and a replace or delete first renames the
+// live object aside, which only one writer can do, then re-checks its
+// generation. A replacement is always stamped later than the object it
+// replaces, so a takeover never sees the old generation again.
+type LocalStore struct {
+	Root string
+}
+
+func NewLocalStore(root string) *LocalStore {
+	return &LocalStore{Root: root}
+}
+
+// objectPath maps an object name to a file path under Root, rejecting names
+// that could escape it.
+func (s *LocalStore) objectPath(object string) (string, error) {
+	if object == "" || strings.HasPrefix(object, "/") || strings.Contains(object, "\\") {
+		return "", fmt.Errorf("local store: invalid object name %q", object)
+	}
+	for _, part := range strings.Split(object, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("local store: invalid object name %q", object)
+		}
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(object)), nil
+}
+
+func (s *LocalStore) Exists(ctx context.Context, object string) (bool, error) {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular(), nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, object, dst string) error {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return err
+	}
+	if err := copyFileAtomic(p, dst); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrNotFound, object)
+		}
+		return fmt.Errorf("local get %s: %w", object, err)
+	}
+	return nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, object, src string) error {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return err
+	}
+	if err := copyFileAtomic(src, p); err != nil {
+		return fmt.Errorf("local put %s: %w", object, err)
+	}
+	return nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]string, error) {
+	// Walk only the directory part of the prefix; the rest is a name filter.
+	dir := s.Root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		dir = filepath.Join(s.Root, filepath.FromSlash(prefix[:i]))
+	}
+
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// Skip in-flight temp files from copyFileAtomic.
+		if base := d.Name(); strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, object string) error {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func localGeneration(fi fs.FileInfo) string {
+	return strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+}
+
+func (s *LocalStore) Stat(ctx context.Context, object string) (ObjectAttrs, error) {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.Mode().IsRegular()) {
+		return ObjectAttrs{}, fmt.Errorf("%w: %s", ErrNotFound, object)
+	}
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	return ObjectAttrs{Generation: localGeneration(fi), Size: fi.Size(), Updated: fi.ModTime()}, nil
+}
+
+func (s *LocalStore) GetGeneration(ctx context.Context, object, generation, dst string) error {
+	attrs, err := s.Stat(ctx, object)
+	if err != nil {
+		return err
+	}
+	if generation != "" && attrs.Generation != generation {
+		return fmt.Errorf("%w: %s generation %s", ErrNotFound, object, generation)
+	}
+	if err := s.Get(ctx, object, dst); err != nil {
+		return err
+	}
+	// A rewrite during the copy means dst may hold the newer bytes.
+	if after, err := s.Stat(ctx, object); err != nil || after.Generation != attrs.Generation {
+		_ = os.Remove(dst)
+		return fmt.Errorf("%w: %s generation %s", ErrNotFound, object, attrs.Generation)
+	}
+	return nil
+}
+
+func (s *LocalStore) PutIfGeneration(ctx context.Context, object, src, ifGeneration string) (string, error) {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return "", err
+	}
+	// Stage under a unique name, so concurrent writers never share a file.
+	tmp, err := stageFile(src, p)
+	if err != nil {
+		return "", fmt.Errorf("local put %s: %w", object, err)
+	}
+	defer os.Remove(tmp)
+
+	if ifGeneration != "0" {
+		old, aside, err := takeAside(p, object, ifGeneration)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(aside)
+		// Never reuse the replaced generation, even where mtimes are coarse.
+		fi, err := os.Stat(tmp)
+		if err != nil {
+			return "", fmt.Errorf("local put %s: %w", object, err)
+		}
+		if !fi.ModTime().After(old.ModTime()) {
+			t := old.ModTime().Add(2 * time.Second) // past FAT's 2s granularity
+			if err := os.Chtimes(tmp, t, t); err != nil {
+				return "", fmt.Errorf("local put %s: %w", object, err)
+			}
+		}
+	}
+	// Link fails if the target exists, so exactly one creator wins.
+	if err := os.Link(tmp, p); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("%w: %s", ErrPreconditionFailed, object)
+		}
+		return "", fmt.Errorf("local put %s: %w", object, err)
+	}
+	fi, err := os.Stat(tmp) // same file as p, even if p is replaced meanwhile
+	if err != nil {
+		return "", fmt.Errorf("local put %s: %w", object, err)
+	}
+	return localGeneration(fi), nil
+}
+
+func (s *LocalStore) DeleteIfGeneration(ctx context.Context, object, ifGeneration string) error {
+	p, err := s.objectPath(object)
+	if err != nil {
+		return err
+	}
+	_, aside, err := takeAside(p, object, ifGeneration)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(aside)
+}
+
+// takeAside moves the object at p to a unique hidden name if it is at
+// generation gen, and returns its info and new path. Only one caller can
+// rename a given file, so the re-check after the rename cannot race another
+// writer; a file replaced between the check and the rename is put back.
+func takeAside(p, object, gen string) (fs.FileInfo, string, error) {
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", fmt.Errorf("%w: %s", ErrNotFound, object)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if localGeneration(fi) != gen {
+		return nil, "", fmt.Errorf("%w: %s", ErrPreconditionFailed, object)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return nil, "", err
+	}
+	aside := f.Name()
+	_ = f.Close()
+	if err := os.Rename(p, aside); err != nil {
+		_ = os.Remove(aside)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", fmt.Errorf("%w: %s", ErrPreconditionFailed, object)
+		}
+		return nil, "", err
+	}
+	fi, err = os.Stat(aside)
+	if err == nil && localGeneration(fi) == gen {
+		return fi, aside, nil
+	}
+	// Someone replaced it first: restore theirs unless the name is taken again.
+	if os.Link(aside, p) == nil {
+		_ = os.Remove(aside)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrPreconditionFailed, object)
+}
+
+// stageFile copies src to a uniquely named hidden temp file next to dst.
+func stageFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, copyErr := io.Copy(tmp, in)
+	closeErr := tmp.Close()
+	if copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		_ = os.Remove(tmp.Name())
+		return "", copyErr
+	}
+	return tmp.Name(), nil
+}
+
+// copyFileAtomic copies src to dst via temp file + rename so readers never
+// observe a partial object.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+path.Base(filepath.ToSlash(dst))+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(tmp, in)
+	closeErr := tmp.Close()
+	if copyErr != nil {
+		_ = os.Remove(tmp.Name())
+		return copyErr
+	}
+	if closeErr != nil {
+		_ = os.Remove(tmp.Name())
+		return closeErr
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package gcsutil
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- S3 / MinIO (env) ----
+//
+//   AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY: credentials (required)
+//   AWS_SESSION_TOKEN: optional STS session token
+//   AWS_REGION:        signing region (default us-east-1)
+//   S3_ENDPOINT:       custom endpoint, e.g. http://localhost:9000 for MinIO.
+//                      When set, path-style addressing is used.
+//
+// Retries and timeouts share the GCS_* knobs above.
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Store is an ObjectStore for S3-compatible APIs (AWS S3, MinIO),
+// authenticated with AWS Signature Version 4.
+type S3Store struct {
+	Bucket       string
+	Region       string
+	Endpoint     string // scheme://host[:port]; empty means AWS virtual-hosted style
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	now func() time.Time
+}
+
+// NewS3StoreFromEnv returns an S3Store for bucket configured from AWS_* / S3_* env vars.
+func NewS3StoreFromEnv(bucket string) (*S3Store, error) {
+	s := &S3Store{
+		Bucket:       bucket,
+		Region:       getenvDefault("AWS_REGION", "us-east-1"),
+		Endpoint:     strings.TrimRight(strings.TrimSpace(os.Getenv("S3_ENDPOINT")), "/"),
+		AccessKey:    strings.TrimSpace(os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretKey:    strings.TrimSpace(os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken: strings.TrimSpace(os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return s, nil
+}
+
+func getenvDefault(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+// objectURL returns the request URL for object ("" addresses the bucket itself).
+func (s *S3Store) objectURL(object string, q url.Values) string {
+	var u string
+	if s.Endpoint != "" {
+		u = s.Endpoint + "/" + s3EscapePath(s.Bucket)
+	} else {
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.Bucket, s.Region)
+	}
+	u += "/" + s3EscapePath(object)
+	if len(q) > 0 {
+		u += "?" + s3CanonicalQuery(q)
+	}
+	return u
+}
+
+func (s *S3Store) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// newRequest builds a signed request. payloadHash is the hex SHA-256 of the body.
+func (s *S3Store) newRequest(ctx context.Context, method, object string, q url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(object, q), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash)
+	return req, nil
+}
+
+// sign adds SigV4 headers to req. Every header already present on req is signed,
+// along with host, x-amz-date and x-amz-content-sha256.
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	t := s.clock().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonURI := req.URL.EscapedPath()
+	if canonURI == "" {
+		canonURI = "/"
+	}
+	canonReq := strings.Join([]string{
+		req.Method,
+		canonURI,
+		s3CanonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonReq)),
+	}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	k = hmacSHA256(k, s.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.AccessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape is RFC 3986 percent-encoding as required by SigV4.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3StatusError classifies a non-2xx S3 response.
+func s3StatusError(op string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	body := strings.TrimSpace(string(b))
+	if shouldRetryStatus(resp.StatusCode) {
+		return retryableStatusError{status: resp.StatusCode, body: body}
+	}
+	return fmt.Errorf("s3 %s status=%d body=%s", op, resp.StatusCode, body)
+}
+
+func (s *S3Store) Exists(ctx context.Context, object string) (bool, error) {
+	exists := false
+	err := doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, downloadTimeout())
+		defer cancel()
+
+		req, err := s.newRequest(cctx, http.MethodHead, object, nil, nil, emptySHA256)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("s3 head request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			exists = false
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			return s3StatusError("head", resp)
+		}
+		exists = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, object, dst string) error {
+	return doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, downloadTimeout())
+		defer cancel()
+
+		req, err := s.newRequest(cctx, http.MethodGet, object, nil, nil, emptySHA256)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("s3 get request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", ErrNotFound, object)
+		}
+		if resp.StatusCode/100 != 2 {
+			return s3StatusError("get", resp)
+		}
+		return writeFileAtomic(dst, resp.Body, nil)
+	})
+}
+
+func (s *S3Store) Put(ctx context.Context, object, src string) error {
+	sum, size, err := fileSHA256(src)
+	if err != nil {
+		return err
+	}
+
+	return doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, uploadTimeout())
+		defer cancel()
+
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		req, err := http.NewRequestWithContext(cctx, http.MethodPut, s.objectURL(object, nil), f)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		s.sign(req, sum)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("s3 put request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return s3StatusError("put", resp)
+		}
+		return nil
+	})
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		var page s3ListResult
+		err := doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+			cctx, cancel := context.WithTimeout(parent, downloadTimeout())
+			defer cancel()
+
+			req, err := s.newRequest(cctx, http.MethodGet, "", q, nil, emptySHA256)
+			if err != nil {
+				return err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return fmt.Errorf("s3 list request: %w", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode/100 != 2 {
+				return s3StatusError("list", resp)
+			}
+			page = s3ListResult{}
+			if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+				return fmt.Errorf("s3 list parse: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			names = append(names, c.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, object string) error {
+	return doWithRetry(ctx, retries(), retryBackoff(), retryMaxBackoff(), func(parent context.Context) error {
+		cctx, cancel := context.WithTimeout(parent, uploadTimeout())
+		defer cancel()
+
+		req, err := s.newRequest(cctx, http.MethodDelete, object, nil, nil, emptySHA256)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("s3 delete request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			return s3StatusError("delete", resp)
+		}
+		return nil
+	})
+}
+
+func fileSHA256(p string) (string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,307 @@
+package gcsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectStore is the bucket surface the server needs. A store is bound to a
+// single bucket; object names are slash-separated keys relative to its root.
+type ObjectStore interface {
+	// Exists reports whether object is present. Not found is not an error.
+	Exists(ctx context.Context, object string) (bool, error)
+	// Get downloads object to the local file dst (atomically). A missing
+	// object yields an error wrapping ErrNotFound on every backend.
+	Get(ctx context.Context, object, dst string) error
+	// Put uploads the local file src as object.
+	Put(ctx context.Context, object, src string) error
+	// List returns object names starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, object string) error
+}
+
+// ObjectAttrs is the object metadata used to pin inputs to one version.
+type ObjectAttrs struct {
+	Generation string
+	Size       int64
+	Updated    time.Time
+}
+
+// Versioned is implemented by stores whose objects carry generations (GCS).
+// The server uses it to download inputs at a fixed generation.
+type Versioned interface {
+	// Stat returns the live object's attributes (ErrNotFound if missing).
+	Stat(ctx context.Context, object string) (ObjectAttrs, error)
+	// GetGeneration downloads one generation of object (ErrNotFound if gone).
+	GetGeneration(ctx context.Context, object, generation, dst string) error
+}
+
+// Conditional is implemented by stores that support generation preconditions
+// (GCS ifGenerationMatch). The server uses it for the run claim.
+type Conditional interface {
+	Versioned
+	// PutIfGeneration uploads src only if the live generation of object is
+	// ifGeneration ("0": object must not exist) and returns the new generation.
+	// A failed precondition yields an error wrapping ErrPreconditionFailed.
+	PutIfGeneration(ctx context.Context, object, src, ifGeneration string) (string, error)
+	// DeleteIfGeneration removes object only at generation ifGeneration.
+	// A missing object is not an error.
+	DeleteIfGeneration(ctx context.Context, object, ifGeneration string) error
+}
+
+// OpenStore returns an ObjectStore for a bucket spec:
+//
+//	<bucket> or gs://<bucket>  GCS JSON API (tokens from DefaultTokenSource)
+//	s3://<bucket>              S3-compatible API (see NewS3StoreFromEnv)
+//	az://<container>           Azure Blob Storage (see NewAzureStoreFromEnv)
+//	file:///<dir>              local directory (no cloud access)
+func OpenStore(ctx context.Context, spec string) (ObjectStore, error) {
+	return OpenStoreAs(ctx, spec, "")
+}
+
+// OpenStoreAs is OpenStore acting as serviceAccount: GCS requests use a token
+// impersonating it (see ImpersonatedTokenSource). "" uses the base identity.
+// Impersonation applies to GCS buckets only and is skipped for emulators.
+func OpenStoreAs(ctx context.Context, spec, serviceAccount string) (ObjectStore, error) {
+	if err := CheckImpersonation(spec, serviceAccount); err != nil {
+		return nil, err
+	}
+	scheme, name, err := parseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "file":
+		return NewLocalStore(name), nil
+	case "s3":
+		return NewS3StoreFromEnv(name)
+	case "az":
+		return NewAzureStoreFromEnv(name)
+	default:
+		ts, err := DefaultTokenSource()
+		if err != nil {
+			return nil, err
+		}
+		if serviceAccount != "" && storageEmulatorHost() == "" {
+			ts = ImpersonatedTokenSource(ts, serviceAccount)
+		}
+		return NewGCSStore(ts, name), nil
+	}
+}
+
+// CheckImpersonation reports an error if spec cannot be opened as
+// serviceAccount, without opening it: impersonation needs a GCS bucket.
+func CheckImpersonation(spec, serviceAccount string) error {
+	if serviceAccount == "" {
+		return nil
+	}
+	scheme, _, err := parseSpec(spec)
+	if err != nil {
+		return err
+	}
+	if scheme != "gs" {
+		return fmt.Errorf("store %q: service account impersonation needs a GCS bucket", spec)
+	}
+	return nil
+}
+
+// BucketName returns the bucket name that events for spec are expected to carry:
+// the bucket (or container) for gs://, s3:// and az:// specs and the base name of the directory for file:// specs.
+func BucketName(spec string) string {
+	scheme, name, err := parseSpec(spec)
+	if err != nil {
+		return strings.TrimSpace(spec)
+	}
+	if scheme == "file" {
+		return filepath.Base(name)
+	}
+	return name
+}
+
+func parseSpec(spec string) (scheme, name string, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return "", "", fmt.Errorf("empty bucket spec")
+	}
+	if !strings.Contains(spec, "://") {
+		return "gs", spec, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("bucket spec %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "gs", "s3", "az":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("bucket spec %q: missing bucket", spec)
+		}
+		return u.Scheme, u.Host, nil
+	case "file":
+		p := u.Path
+		// file:///C:/dir -> C:/dir on Windows.
+		if len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+			p = p[1:]
+		}
+		if p == "" {
+			return "", "", fmt.Errorf("bucket spec %q: missing directory", spec)
+		}
+		return "file", filepath.FromSlash(p), nil
+	default:
+		return "", "", fmt.Errorf("bucket spec %q: unsupported scheme %q", spec, u.Scheme)
+	}
+}
+
+// PutDir uploads every file under dir to s as prefix/<rel path>. Non-marker
+// files are uploaded by up to GCS_UPLOAD_CONCURRENCY workers; completion
+// markers are uploaded only after every other file succeeded.
+//
+// On failure the remaining uploads are cancelled and the error of the earliest
+// failing file (in collectFilePaths order) is returned.
+func PutDir(ctx context.Context, s ObjectStore, prefix, dir string) error {
+	files, err := collectFilePaths(dir)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]string, len(files))
+	for i, p := range files {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		objs[i] = path.Join(prefix, filepath.ToSlash(rel))
+	}
+
+	// collectFilePaths puts markers at the end.
+	n := len(files)
+	for n > 0 && isMarker(files[n-1]) {
+		n--
+	}
+
+	if err := putParallel(ctx, s, objs[:n], files[:n], uploadConcurrency()); err != nil {
+		return err
+	}
+	for i := n; i < len(files); i++ {
+		if err := s.Put(ctx, objs[i], files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMarker(p string) bool {
+	base := filepath.Base(p)
+	return base == "_SUCCESS.json" || base == "_ERROR.json"
+}
+
+func putParallel(ctx context.Context, s ObjectStore, objs, files []string, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(files))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := s.Put(cctx, objs[i], files[i]); err != nil {
+					errs[i] = err
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range files {
+		select {
+		case jobs <- i:
+		case <-cctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Prefer a real failure over uploads that were cancelled because of it.
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if ctx.Err() == nil && errors.Is(err, context.Canceled) {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		return err
+	}
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// GCSStore is the GCS JSON API implementation of ObjectStore.
+type GCSStore struct {
+	Tokens TokenSource
+	Bucket string
+}
+
+func NewGCSStore(ts TokenSource, bucket string) *GCSStore {
+	return &GCSStore{Tokens: ts, Bucket: bucket}
+}
+
+func (s *GCSStore) Exists(ctx context.Context, object string) (bool, error) {
+	return ObjectExists(ctx, s.Tokens, s.Bucket, object)
+}
+
+func (s *GCSStore) Get(ctx context.Context, object, dst string) error {
+	return DownloadToFile(ctx, s.Tokens, s.Bucket, object, dst)
+}
+
+func (s *GCSStore) Put(ctx context.Context, object, src string) error {
+	return UploadFile(ctx, s.Tokens, s.Bucket, object, src)
+}
+
+func (s *GCSStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return ListObjects(ctx, s.Tokens, s.Bucket, prefix)
+}
+
+func (s *GCSStore) Delete(ctx context.Context, object string) error {
+	return DeleteObject(ctx, s.Tokens, s.Bucket, object)
+}
+
+func (s *GCSStore) Stat(ctx context.Context, object string) (ObjectAttrs, error) {
+	return StatObject(ctx, s.Tokens, s.Bucket, object)
+}
+
+func (s *GCSStore) GetGeneration(ctx context.Context, object, generation, dst string) error {
+	return DownloadGeneration(ctx, s.Tokens, s.Bucket, object, generation, dst)
+}
+
+func (s *GCSStore) PutIfGeneration(ctx context.Context, object, src, ifGeneration string) (string, error) {
+	return UploadFileIfGeneration(ctx, s.Tokens, s.Bucket, object, src, ifGeneration)
+}
+
+func (s *GCSStore) DeleteIfGeneration(ctx context.Context, object, ifGeneration string) error {
+	return DeleteObjectIfGeneration(ctx, s.Tokens, s.Bucket, object, ifGeneration)
+}
@@ -0,0 +1,285 @@
+package gcsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketName(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"inbucket", "inbucket"},
+		{"gs://inbucket", "inbucket"},
+		{"file:///tmp/drop/inbucket", "inbucket"},
+	}
+	for _, tt := range tests {
+		if got := BucketName(tt.spec); got != tt.want {
+			t.Fatalf("BucketName(%q)=%q want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestOpenStore_RejectsUnknownScheme(t *testing.T) {
+	if _, err := OpenStore(context.Background(), "ftp://bucket"); err == nil {
+		t.Fatalf("expected error for unsupported scheme")
+	}
+}
+
+func TestLocalStore_RoundTrip(t *testing.T) {
+	root := t.TempDir()
+	ctx := context.Background()
+
+	s, err := OpenStore(ctx, "file://"+filepath.ToSlash(root))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if _, ok := s.(*LocalStore); !ok {
+		t.Fatalf("expected *LocalStore, got %T", s)
+	}
+
+	src := filepath.Join(t.TempDir(), "src.csv")
+	mustWrite(t, src, "id\n1\n")
+
+	if err := s.Put(ctx, "in/demo/right.csv", src); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	ok, err := s.Exists(ctx, "in/demo/right.csv")
+	if err != nil || !ok {
+		t.Fatalf("Exists=%v err=%v want true", ok, err)
+	}
+	ok, err = s.Exists(ctx, "in/demo/left.csv")
+	if err != nil || ok {
+		t.Fatalf("Exists(missing)=%v err=%v want false", ok, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst.csv")
+	if err := s.Get(ctx, "in/demo/right.csv", dst); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "id\n1\n" {
+		t.Fatalf("Get content=%q", b)
+	}
+
+	if err := s.Delete(ctx, "in/demo/right.csv"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "in/demo/right.csv"); err != nil {
+		t.Fatalf("Delete(missing): %v", err)
+	}
+
+	for _, bad := range []string{"../escape", "in/../../x", "/abs", "in//x"} {
+		if err := s.Put(ctx, bad, src); err == nil {
+			t.Fatalf("Put(%q) expected error", bad)
+		}
+	}
+}
+
+// recordingStore records Put order; other methods are unused.
+type recordingStore struct {
+	ObjectStore
+	mu   sync.Mutex
+	puts []string
+	fail map[string]error
+}
+
+func (s *recordingStore) Put(ctx context.Context, object, src string) error {
+	if err := s.fail[object]; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.puts = append(s.puts, object)
+	return nil
+}
+
+func TestPutDir_MarkerLast(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		mustWrite(t, filepath.Join(dir, "tree", "work", fmt.Sprintf("f%02d.csv", i)), "x")
+	}
+	mustWrite(t, filepath.Join(dir, "_SUCCESS.json"), "{}")
+
+	for _, conc := range []string{"1", "4"} {
+		t.Run("concurrency="+conc, func(t *testing.T) {
+			t.Setenv("GCS_UPLOAD_CONCURRENCY", conc)
+
+			s := &recordingStore{}
+			if err := PutDir(context.Background(), s, "out/demo", dir); err != nil {
+				t.Fatalf("PutDir: %v", err)
+			}
+			if len(s.puts) != 21 {
+				t.Fatalf("puts=%d want 21", len(s.puts))
+			}
+			if last := s.puts[len(s.puts)-1]; last != "out/demo/_SUCCESS.json" {
+				t.Fatalf("last put=%q want marker", last)
+			}
+			if conc == "1" && s.puts[0] != "out/demo/tree/work/f00.csv" {
+				t.Fatalf("sequential order broken: %v", s.puts)
+			}
+		})
+	}
+}
+
+func TestPutDir_FailureSkipsMarker(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		mustWrite(t, filepath.Join(dir, fmt.Sprintf("f%02d.csv", i)), "x")
+	}
+	mustWrite(t, filepath.Join(dir, "_ERROR.json"), "{}")
+	t.Setenv("GCS_UPLOAD_CONCURRENCY", "3")
+
+	boom := errors.New("boom f03")
+	s := &recordingStore{fail: map[string]error{
+		"out/x/f03.csv": boom,
+		"out/x/f07.csv": errors.New("boom f07"),
+	}}
+	err := PutDir(context.Background(), s, "out/x", dir)
+	if !errors.Is(err, boom) {
+		t.Fatalf("err=%v want %v", err, boom)
+	}
+	for _, p := range s.puts {
+		if p == "out/x/_ERROR.json" {
+			t.Fatalf("marker uploaded after failure: %v", s.puts)
+		}
+	}
+}
+
+func TestConditional_CreateOnceAndDeleteAtGeneration(t *testing.T) {
+	useFake(t)
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+
+	stores := map[string]Conditional{
+		"gcs":   NewGCSStore(StaticToken("tok"), "b"),
+		"local": NewLocalStore(t.TempDir()),
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			src := filepath.Join(t.TempDir(), "claim.json")
+			mustWrite(t, src, "{}\n")
+			const obj = "out/demo/_RUNNING.json"
+
+			gen, err := s.PutIfGeneration(ctx, obj, src, "0")
+			if err != nil || gen == "" {
+				t.Fatalf("create: gen=%q err=%v", gen, err)
+			}
+			if _, err := s.PutIfGeneration(ctx, obj, src, "0"); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("second create err=%v want ErrPreconditionFailed", err)
+			}
+			if _, err := s.PutIfGeneration(ctx, obj, src, gen+"1"); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("replace at wrong generation err=%v want ErrPreconditionFailed", err)
+			}
+			if err := s.DeleteIfGeneration(ctx, obj, gen+"1"); !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("delete at wrong generation err=%v want ErrPreconditionFailed", err)
+			}
+			attrs, err := s.Stat(ctx, obj)
+			if err != nil || attrs.Generation != gen {
+				t.Fatalf("Stat=%+v err=%v want generation %s", attrs, err, gen)
+			}
+			if err := s.DeleteIfGeneration(ctx, obj, gen); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, err := s.Stat(ctx, obj); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Stat after delete err=%v want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestStores_GetMissingIsErrNotFound(t *testing.T) {
+	useFake(t)
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+
+	stores := map[string]ObjectStore{
+		"gcs":   NewGCSStore(StaticToken("tok"), "b"),
+		"local": NewLocalStore(t.TempDir()),
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dl.csv")
+			if err := s.Get(context.Background(), "in/demo/left.csv", dst); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Get(missing) err=%v want ErrNotFound", err)
+			}
+			if _, err := os.Stat(dst); !os.IsNotExist(err) {
+				t.Fatalf("dst exists after failed Get (err=%v)", err)
+			}
+		})
+	}
+}
+
+func TestOpenStoreAs_ImpersonationNeedsGCS(t *testing.T) {
+	if _, err := OpenStoreAs(context.Background(), "file:///tmp/x", "sa@p.iam.gserviceaccount.com"); err == nil {
+		t.Fatalf("expected error for impersonation on a file:// store")
+	}
+}
+
+func TestLocalStore_ConditionalWritesRace(t *testing.T) {
+	ctx := context.Background()
+	s := NewLocalStore(t.TempDir())
+	const obj = "out/demo/_RUNNING.json"
+
+	// race runs concurrent PutIfGeneration calls and returns the winners'
+	// generations; every loser must see ErrPreconditionFailed.
+	race := func(ifGeneration string) []string {
+		t.Helper()
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var wins []string
+		for i := 0; i < 16; i++ {
+			src := filepath.Join(t.TempDir(), "claim.json")
+			mustWrite(t, src, fmt.Sprintf("{\"owner\":%d}\n", i))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				gen, err := s.PutIfGeneration(ctx, obj, src, ifGeneration)
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					wins = append(wins, gen)
+				} else if !errors.Is(err, ErrPreconditionFailed) {
+					t.Errorf("PutIfGeneration(%s): %v", ifGeneration, err)
+				}
+			}()
+		}
+		wg.Wait()
+		return wins
+	}
+
+	if wins := race("0"); len(wins) != 1 {
+		t.Fatalf("create: winners=%v want 1", wins)
+	}
+	// A claim stamped in the future: a takeover must still get a later generation.
+	p := filepath.Join(s.Root, filepath.FromSlash(obj))
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(p, future, future); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.Stat(ctx, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wins := race(old.Generation)
+	if len(wins) != 1 {
+		t.Fatalf("takeover: winners=%v want 1", wins)
+	}
+	cur, err := s.Stat(ctx, obj)
+	if err != nil || cur.Generation != wins[0] || !cur.Updated.After(old.Updated) {
+		t.Fatalf("Stat=%+v err=%v want generation %s after %+v", cur, err, wins[0], old)
+	}
+	// Staged and set-aside files are all cleaned up.
+	entries, err := os.ReadDir(filepath.Dir(p))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("entries=%v err=%v want only the claim", entries, err)
+	}
+}
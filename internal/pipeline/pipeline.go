@@ -3,21 +3,93 @@ package pipeline
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/recon"
 )
 
 type Config struct {
-	LeftPath     string
-	RightPath    string
-	OutBase      string
-	RunID        string
+	LeftPath  string
+	RightPath string
+
+	// Inputs, when set, replaces LeftPath/RightPath with a named list of
+	// inputs (e.g. bank, ledger, processor). Each is copied to
+	// tree/inputs/<name>.csv and reconciled according to Mode.
+	Inputs []Input
+	// Mode selects which pairs are reconciled: ModePairwise (default) or
+	// ModeHub. Hub names the hub input (default: the first input).
+	Mode string
+	Hub  string
+
+	OutBase string
+	RunID   string
+
+	// Engine selects the reconciliation engine: EngineExternal (default)
+	// runs ReconBin; EngineNative runs internal/recon in-process.
+	Engine string
+	// SpecPath, when set, is a recon spec (JSON; see recon.LoadSpec) that
+	// chooses key, compared and ignored columns and maps right-file column
+	// names. It needs EngineNative and is copied to tree/inputs/spec.json.
+	SpecPath     string
 	ReconBin     string
 	AuditpackBin string
 	Label        string
+
+	// Sources, when set, is written to tree/sources.json so the pack attests
+	// to exactly which objects (and bytes) the inputs were downloaded from.
+	Sources []Source
+}
+
+// Source describes where one input file came from.
+type Source struct {
+	Name   string `json:"name"`   // stable input name, e.g. "left.csv"
+	Object string `json:"object"` // storage object name, e.g. "in/<run_id>/left.csv"
+	// Generation is the pinned object generation, when the store has one.
+	Generation string `json:"generation,omitempty"`
+	Size       int64  `json:"size"`
+	CRC32C     string `json:"crc32c"` // base64, as reported by GCS
+	MD5        string `json:"md5"`    // base64, as reported by GCS
+	SHA256     string `json:"sha256"` // hex
+}
+
+// Reconciliation engines.
+const (
+	EngineExternal = "external" // the pinned recon binary (ReconBin)
+	EngineNative   = "native"   // internal/recon, in-process
+)
+
+// Input is one named input file.
+type Input struct {
+	Name string // stable name without extension, e.g. "bank"
+	Path string
+}
+
+// Recon modes for more than one pair of inputs.
+const (
+	ModePairwise = "pairwise" // every pair, in input order
+	ModeHub      = "hub"      // the hub against every other input
+)
+
+// Plan records the recon invocations of a named-input run. It is written to
+// tree/recon.json, so the pack attests to which pairs were reconciled.
+type Plan struct {
+	Mode   string     `json:"mode"`
+	Hub    string     `json:"hub,omitempty"`
+	Inputs []string   `json:"inputs"`
+	Pairs  []PlanPair `json:"pairs"`
+}
+
+// PlanPair is one recon invocation.
+type PlanPair struct {
+	Left   string `json:"left"`
+	Right  string `json:"right"`
+	Work   string `json:"work"`   // tree-relative output directory
+	Status string `json:"status"` // "ok" or "error"
 }
 
 type Result struct {
@@ -37,6 +109,23 @@ func Run(ctx context.Context, cfg Config) (Result, error) {
 		cfg.Label = "job:" + cfg.RunID
 	}
 
+	switch cfg.Engine {
+	case "", EngineExternal, EngineNative:
+	default:
+		return Result{}, fmt.Errorf("unknown recon engine %q (want %s or %s)", cfg.Engine, EngineExternal, EngineNative)
+	}
+
+	var opts recon.Options
+	if cfg.SpecPath != "" {
+		if cfg.Engine != EngineNative {
+			return Result{}, fmt.Errorf("a recon spec needs the %s engine", EngineNative)
+		}
+		var err error
+		if opts, err = recon.LoadSpec(cfg.SpecPath); err != nil {
+			return Result{}, err
+		}
+	}
+
 	runDir := filepath.Join(cfg.OutBase, cfg.RunID)
 	treeDir := filepath.Join(runDir, "tree")
 	inputsDir := filepath.Join(treeDir, "inputs")
@@ -50,24 +139,42 @@ func Run(ctx context.Context, cfg Config) (Result, error) {
 		}
 	}
 
-	// Copy inputs to stable names
-	leftDst := filepath.Join(inputsDir, "left.csv")
-	rightDst := filepath.Join(inputsDir, "right.csv")
-	if err := copyFile(cfg.LeftPath, leftDst); err != nil {
+	inputs, err := cfg.inputs()
+	if err != nil {
 		return Result{}, err
 	}
-	if err := copyFile(cfg.RightPath, rightDst); err != nil {
-		return Result{}, err
+
+	// Copy inputs to stable names
+	for i, in := range inputs {
+		dst := filepath.Join(inputsDir, in.Name+".csv")
+		if err := copyFile(in.Path, dst); err != nil {
+			return Result{}, err
+		}
+		inputs[i].Path = dst
+	}
+	if cfg.SpecPath != "" {
+		// The pack records the rules that were applied.
+		if err := copyFile(cfg.SpecPath, filepath.Join(inputsDir, "spec.json")); err != nil {
+			return Result{}, err
+		}
+	}
+	if len(cfg.Sources) > 0 {
+		if err := writeJSON(filepath.Join(treeDir, "sources.json"), cfg.Sources); err != nil {
+			return Result{}, err
+		}
 	}
 
-	// Run recon
-	reconCmd := exec.CommandContext(ctx, cfg.ReconBin,
-		"run",
-		"--left", leftDst,
-		"--right", rightDst,
-		"--out", workDir,
-	)
-	reconOut, reconErr := runCombined(reconCmd)
+	var reconOut string
+	var reconErr error
+	if legacyInputs(inputs) {
+		// Run recon
+		reconOut, reconErr = reconcile(ctx, cfg, opts, inputs[0].Path, inputs[1].Path, workDir)
+	} else {
+		reconOut, reconErr, err = runPlan(ctx, cfg, opts, inputs, treeDir)
+		if err != nil {
+			return Result{}, err
+		}
+	}
 
 	// If recon fails, record deterministic evidence (but still pack it).
 	if reconErr != nil {
@@ -106,6 +213,165 @@ func Run(ctx context.Context, cfg Config) (Result, error) {
 	return Result{RunDir: runDir, TreeDir: treeDir, PackDir: packDir}, nil
 }
 
+// inputs returns the named inputs (left/right when Inputs is unset).
+func (cfg Config) inputs() ([]Input, error) {
+	if len(cfg.Inputs) == 0 {
+		if cfg.Mode != "" || cfg.Hub != "" {
+			return nil, fmt.Errorf("recon mode and hub need named Inputs, not LeftPath/RightPath")
+		}
+		return []Input{{Name: "left", Path: cfg.LeftPath}, {Name: "right", Path: cfg.RightPath}}, nil
+	}
+	if len(cfg.Inputs) < 2 {
+		return nil, fmt.Errorf("need at least two inputs, got %d", len(cfg.Inputs))
+	}
+	seen := map[string]bool{}
+	for _, in := range cfg.Inputs {
+		if !ValidInputName(in.Name) {
+			return nil, fmt.Errorf("invalid input name %q", in.Name)
+		}
+		if seen[in.Name] {
+			return nil, fmt.Errorf("duplicate input name %q", in.Name)
+		}
+		seen[in.Name] = true
+	}
+	if legacyInputs(cfg.Inputs) && (cfg.Mode != "" || cfg.Hub != "") {
+		// left and right keep the single-recon layout, where a mode has no effect.
+		return nil, fmt.Errorf("recon mode and hub need named inputs other than left and right")
+	}
+	switch cfg.Mode {
+	case "", ModePairwise:
+	case ModeHub:
+		if cfg.Hub != "" && !seen[cfg.Hub] {
+			return nil, fmt.Errorf("hub %q is not an input", cfg.Hub)
+		}
+	default:
+		return nil, fmt.Errorf("unknown recon mode %q (want %s or %s)", cfg.Mode, ModePairwise, ModeHub)
+	}
+	if cfg.Hub != "" && cfg.Mode != ModeHub {
+		return nil, fmt.Errorf("hub %q needs recon mode %s", cfg.Hub, ModeHub)
+	}
+	return append([]Input(nil), cfg.Inputs...), nil
+}
+
+// ValidInputName reports whether name is usable as an input name: 1–64
+// chars, alphanumeric first, then alphanumerics, '-' or '_' (the run_id rule).
+func ValidInputName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i, r := range name {
+		alnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !alnum && (i == 0 || (r != '-' && r != '_')) {
+			return false
+		}
+	}
+	return true
+}
+
+// legacyInputs reports whether inputs are exactly left and right, which keep
+// the original layout (recon output directly in tree/work, no recon.json).
+func legacyInputs(inputs []Input) bool {
+	return len(inputs) == 2 && inputs[0].Name == "left" && inputs[1].Name == "right"
+}
+
+// plan lists the pairs to reconcile, in a deterministic order.
+func (cfg Config) plan(inputs []Input) Plan {
+	p := Plan{Mode: ModePairwise}
+	for _, in := range inputs {
+		p.Inputs = append(p.Inputs, in.Name)
+	}
+	add := func(l, r string) {
+		p.Pairs = append(p.Pairs, PlanPair{Left: l, Right: r, Work: "work/" + l + "/" + r})
+	}
+	if cfg.Mode == ModeHub {
+		p.Mode, p.Hub = ModeHub, cfg.Hub
+		if p.Hub == "" {
+			p.Hub = inputs[0].Name
+		}
+		for _, in := range inputs {
+			if in.Name != p.Hub {
+				add(p.Hub, in.Name)
+			}
+		}
+		return p
+	}
+	for i := range inputs {
+		for j := i + 1; j < len(inputs); j++ {
+			add(inputs[i].Name, inputs[j].Name)
+		}
+	}
+	return p
+}
+
+// runPlan runs recon once per pair into tree/work/<left>/<right> and writes
+// tree/recon.json. Every pair runs even if an earlier one fails; the combined
+// output of failed pairs and the first recon error are returned for
+// tree/error.txt. err reports local I/O failures.
+func runPlan(ctx context.Context, cfg Config, opts recon.Options, inputs []Input, treeDir string) (reconOut string, reconErr, err error) {
+	paths := map[string]string{}
+	for _, in := range inputs {
+		paths[in.Name] = in.Path
+	}
+
+	plan := cfg.plan(inputs)
+	var failed bytes.Buffer
+	for i, pr := range plan.Pairs {
+		dir := filepath.Join(treeDir, filepath.FromSlash(pr.Work))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", nil, err
+		}
+		out, runErr := reconcile(ctx, cfg, opts, paths[pr.Left], paths[pr.Right], dir)
+		plan.Pairs[i].Status = "ok"
+		if runErr != nil {
+			plan.Pairs[i].Status = "error"
+			fmt.Fprintf(&failed, "== %s vs %s ==\n%s", pr.Left, pr.Right, out)
+			if reconErr == nil {
+				reconErr = fmt.Errorf("recon %s vs %s: %w", pr.Left, pr.Right, runErr)
+			}
+		}
+	}
+	if err := writeJSON(filepath.Join(treeDir, "recon.json"), plan); err != nil {
+		return "", nil, err
+	}
+	return failed.String(), reconErr, nil
+}
+
+// reconcile runs one recon invocation with the configured engine and returns
+// its output (the evidence for tree/error.txt when it fails).
+func reconcile(ctx context.Context, cfg Config, opts recon.Options, left, right, out string) (string, error) {
+	if cfg.Engine == EngineNative {
+		if _, err := recon.Run(left, right, out, opts); err != nil {
+			return recon.ErrorText(err), err
+		}
+		return "", nil
+	}
+	reconCmd := exec.CommandContext(ctx, cfg.ReconBin,
+		"run",
+		"--left", left,
+		"--right", right,
+		"--out", out,
+	)
+	return runCombined(reconCmd)
+}
+
+// writeJSON writes v as indented JSON with a trailing newline (temp + rename).
+func writeJSON(p string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 func runCombined(cmd *exec.Cmd) (string, error) {
 	var buf bytes.Buffer
 	cmd.Stdout = &buf
@@ -0,0 +1,398 @@
+// Package recon is the native, in-process reconciliation engine. It matches
+// two CSV files on a key column and classifies every key as matched,
+// left_only, right_only or mismatched, writing the same work files as the
+// pinned recon tool so either engine can feed auditpack.
+package recon
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// DefaultKey is the key column used when Options.Key is empty.
+const DefaultKey = "id"
+
+// Options customizes matching. The zero value matches on DefaultKey and
+// compares every column of two files with identical headers. Options is also
+// the recon spec file format (see LoadSpec); column names refer to the left
+// file's header, after RenameRight has been applied to the right file's.
+type Options struct {
+	// Key lists the key columns; several make a composite key.
+	Key []string `json:"key,omitempty"`
+	// Compare lists the columns compared for matched keys (default: every
+	// column both files share, except key and Ignore columns).
+	Compare []string `json:"compare,omitempty"`
+	// Ignore lists columns never compared.
+	Ignore []string `json:"ignore,omitempty"`
+	// RenameRight maps right-file column names to left-file names, e.g.
+	// {"txn_id": "id"}, for files whose headers differ.
+	RenameRight map[string]string `json:"rename_right,omitempty"`
+	// Tolerances maps compared columns to rules under which differing
+	// values still match; such keys land in matched_within_tolerance.
+	Tolerances map[string]Tolerance `json:"tolerances,omitempty"`
+}
+
+// custom reports whether any option departs from the defaults, in which case
+// headers may differ and only the key and compared columns must line up.
+func (o Options) custom() bool {
+	return len(o.Key) > 0 || len(o.Compare) > 0 || len(o.Ignore) > 0 || len(o.RenameRight) > 0
+}
+
+// Table is a parsed CSV file: a header and its rows.
+type Table struct {
+	Name   string // file name used in error messages, e.g. "left.csv"
+	Header []string
+	Rows   [][]string
+}
+
+// Mismatch is one differing field of a key present on both sides.
+type Mismatch struct {
+	Key   []string // key column values
+	Field string
+	Left  string
+	Right string
+}
+
+// Result is the classification of every key, each list sorted by key.
+// Matched and LeftOnly rows follow Header; RightOnly rows follow RightHeader.
+type Result struct {
+	Header      []string
+	RightHeader []string
+	Key         []string
+	Matched     [][]string
+	LeftOnly    [][]string
+	RightOnly   [][]string
+	Mismatched  []Mismatch
+	// WithinTolerance lists the accepted differences of keys that matched
+	// only thanks to a tolerance rule (nil unless Options.Tolerances is set).
+	WithinTolerance []Tolerated
+	tolerances      bool
+
+	LeftRows  int
+	RightRows int
+}
+
+// Summary is written to summary.json.
+type Summary struct {
+	LeftRows  int `json:"left_rows"`
+	RightRows int `json:"right_rows"`
+	Matched   int `json:"matched"`
+	// WithinTolerance counts keys matched only within a tolerance rule;
+	// it is reported only when tolerances are configured.
+	WithinTolerance *int `json:"matched_within_tolerance,omitempty"`
+	LeftOnly        int  `json:"left_only"`
+	RightOnly       int  `json:"right_only"`
+	Mismatched      int  `json:"mismatched"` // keys with at least one differing field
+}
+
+// Run reconciles two CSV files into outDir (matched.csv, left_only.csv,
+// right_only.csv, mismatched.csv, summary.json). Errors describe bad input
+// data; nothing is written when they occur.
+func Run(leftPath, rightPath, outDir string, opts Options) (Summary, error) {
+	left, err := ReadCSV(leftPath)
+	if err != nil {
+		return Summary{}, err
+	}
+	right, err := ReadCSV(rightPath)
+	if err != nil {
+		return Summary{}, err
+	}
+	res, err := Reconcile(left, right, opts)
+	if err != nil {
+		return Summary{}, err
+	}
+	if err := res.Write(outDir); err != nil {
+		return Summary{}, err
+	}
+	return res.Summary(), nil
+}
+
+// ErrorText is the evidence recorded in tree/error.txt when Run reports bad
+// data, in the form the recon tool prints it.
+func ErrorText(err error) string {
+	return "recon: " + err.Error() + "\n"
+}
+
+// ReadCSV parses a CSV file with a header row. Every row must have as many
+// fields as the header.
+func ReadCSV(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	name := filepath.Base(path)
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: empty file (no header)", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	t := &Table{Name: name, Header: header}
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, nil
+}
+
+// Reconcile matches left and right on the key columns. Without custom
+// options both tables must have the same header; keys must be non-empty and
+// unique on each side.
+func Reconcile(left, right *Table, opts Options) (*Result, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	key := opts.Key
+	if len(key) == 0 {
+		key = []string{DefaultKey}
+	}
+	rightHeader := make([]string, len(right.Header))
+	for i, h := range right.Header {
+		rightHeader[i] = h
+		if to, ok := opts.RenameRight[h]; ok {
+			rightHeader[i] = to
+		}
+	}
+	if !opts.custom() && !slices.Equal(left.Header, rightHeader) {
+		return nil, fmt.Errorf("header mismatch: %s has %q, %s has %q",
+			left.Name, strings.Join(left.Header, ","), right.Name, strings.Join(right.Header, ","))
+	}
+
+	lcol, rcol := columns(left.Header), columns(rightHeader)
+	if len(rcol) != len(rightHeader) {
+		return nil, fmt.Errorf("%s: duplicate column names in %q (after rename_right)", right.Name, strings.Join(rightHeader, ","))
+	}
+	for _, c := range append(append([]string(nil), key...), opts.Compare...) {
+		if _, ok := lcol[c]; !ok {
+			return nil, fmt.Errorf("column %q not in %s header %q", c, left.Name, strings.Join(left.Header, ","))
+		}
+		if _, ok := rcol[c]; !ok {
+			return nil, fmt.Errorf("column %q not in %s header %q", c, right.Name, strings.Join(rightHeader, ","))
+		}
+	}
+
+	// Compared columns, in left header order unless listed explicitly.
+	compare := opts.Compare
+	if len(compare) == 0 {
+		for _, h := range left.Header {
+			_, shared := rcol[h]
+			if shared && !(opts.custom() && slices.Contains(key, h)) && !slices.Contains(opts.Ignore, h) {
+				compare = append(compare, h)
+			}
+		}
+	}
+
+	l, err := index(left, lcol, key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := index(right, rcol, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range toleranceColumns(opts.Tolerances) {
+		if !slices.Contains(compare, c) {
+			return nil, fmt.Errorf("tolerance for column %q, which is not compared", c)
+		}
+		if slices.Contains(key, c) {
+			return nil, fmt.Errorf("tolerance for key column %q (keys match exactly)", c)
+		}
+	}
+
+	res := &Result{Header: left.Header, RightHeader: right.Header, Key: key, LeftRows: len(left.Rows), RightRows: len(right.Rows),
+		tolerances: len(opts.Tolerances) > 0}
+	for _, lk := range sorted(l) {
+		lrow := lk.row
+		rk, ok := r[keyID(lk.key)]
+		if !ok {
+			res.LeftOnly = append(res.LeftOnly, lrow)
+			continue
+		}
+		rrow := rk.row
+		var diffs []Mismatch
+		var tolerated []Tolerated
+		for _, c := range compare {
+			lv, rv := lrow[lcol[c]], rrow[rcol[c]]
+			if lv == rv {
+				continue
+			}
+			m := Mismatch{Key: lk.key, Field: c, Left: lv, Right: rv}
+			if t, ok := opts.Tolerances[c]; ok {
+				if rule, ok := t.accept(lv, rv); ok {
+					tolerated = append(tolerated, Tolerated{Mismatch: m, Rule: rule})
+					continue
+				}
+			}
+			diffs = append(diffs, m)
+		}
+		switch {
+		case len(diffs) > 0:
+			res.Mismatched = append(res.Mismatched, diffs...)
+		case len(tolerated) > 0:
+			res.WithinTolerance = append(res.WithinTolerance, tolerated...)
+		default:
+			res.Matched = append(res.Matched, lrow)
+		}
+	}
+	for _, rk := range sorted(r) {
+		if _, ok := l[keyID(rk.key)]; !ok {
+			res.RightOnly = append(res.RightOnly, rk.row)
+		}
+	}
+	return res, nil
+}
+
+// Summary counts the result's buckets.
+func (res *Result) Summary() Summary {
+	s := Summary{
+		LeftRows:  res.LeftRows,
+		RightRows: res.RightRows,
+		Matched:   len(res.Matched),
+		LeftOnly:  len(res.LeftOnly),
+		RightOnly: len(res.RightOnly),
+	}
+	for i, m := range res.Mismatched {
+		if i == 0 || !slices.Equal(m.Key, res.Mismatched[i-1].Key) {
+			s.Mismatched++
+		}
+	}
+	if res.tolerances {
+		n := 0
+		for i, t := range res.WithinTolerance {
+			if i == 0 || !slices.Equal(t.Key, res.WithinTolerance[i-1].Key) {
+				n++
+			}
+		}
+		s.WithinTolerance = &n
+	}
+	return s
+}
+
+// Write writes the result files into outDir.
+func (res *Result) Write(outDir string) error {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return err
+	}
+	mismatched := make([][]string, 0, len(res.Mismatched))
+	for _, m := range res.Mismatched {
+		mismatched = append(mismatched, append(slices.Clone(m.Key), m.Field, m.Left, m.Right))
+	}
+	type outFile struct {
+		name   string
+		header []string
+		rows   [][]string
+	}
+	files := []outFile{
+		{"matched.csv", res.Header, res.Matched},
+		{"left_only.csv", res.Header, res.LeftOnly},
+		{"right_only.csv", res.RightHeader, res.RightOnly},
+		{"mismatched.csv", append(slices.Clone(res.Key), "field", "left", "right"), mismatched},
+	}
+	if res.tolerances {
+		tolerated := make([][]string, 0, len(res.WithinTolerance))
+		for _, t := range res.WithinTolerance {
+			tolerated = append(tolerated, append(slices.Clone(t.Key), t.Field, t.Left, t.Right, t.Rule))
+		}
+		files = append(files, outFile{"matched_within_tolerance.csv", append(slices.Clone(res.Key), "field", "left", "right", "rule"), tolerated})
+	}
+	for _, f := range files {
+		if err := writeCSV(filepath.Join(outDir, f.name), f.header, f.rows); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(res.Summary(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, "summary.json"), append(b, '\n'), 0o644)
+}
+
+// columns maps column names to their index.
+func columns(header []string) map[string]int {
+	m := make(map[string]int, len(header))
+	for i, h := range header {
+		m[h] = i
+	}
+	return m
+}
+
+// keyedRow is a row and its (possibly composite) key values.
+type keyedRow struct {
+	key []string
+	row []string
+}
+
+// index maps each row's key id to the row.
+func index(t *Table, cols map[string]int, key []string) (map[string]keyedRow, error) {
+	m := make(map[string]keyedRow, len(t.Rows))
+	for i, row := range t.Rows {
+		parts := make([]string, len(key))
+		empty := true
+		for j, c := range key {
+			parts[j] = row[cols[c]]
+			empty = empty && parts[j] == ""
+		}
+		if empty {
+			return nil, fmt.Errorf("%s: row %d: empty key", t.Name, i+2)
+		}
+		id := keyID(parts)
+		if _, dup := m[id]; dup {
+			return nil, fmt.Errorf("%s: row %d: duplicate key %q", t.Name, i+2, strings.Join(parts, ","))
+		}
+		m[id] = keyedRow{key: parts, row: row}
+	}
+	return m, nil
+}
+
+// keyID encodes key values unambiguously for use as a map key.
+func keyID(parts []string) string {
+	var b strings.Builder
+	for _, p := range parts {
+		fmt.Fprintf(&b, "%d:%s;", len(p), p)
+	}
+	return b.String()
+}
+
+// sorted returns the rows of m ordered by key values, column by column.
+func sorted(m map[string]keyedRow) []keyedRow {
+	rows := make([]keyedRow, 0, len(m))
+	for _, kr := range m {
+		rows = append(rows, kr)
+	}
+	sort.Slice(rows, func(i, j int) bool { return slices.Compare(rows[i].key, rows[j].key) < 0 })
+	return rows
+}
+
+func writeCSV(p string, header []string, rows [][]string) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return os.WriteFile(p, buf.Bytes(), 0o644)
+}
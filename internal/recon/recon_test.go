@@ -0,0 +1,339 @@
+package recon
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestGolden compares the engine with the pinned recon tool (recon@book-v1)
+// on the repo fixtures: every work file, and for bad data the text written to
+// tree/error.txt. Expected outputs always come from the tool, never from this
+// engine: with RECON_BIN set the tool is run directly (and, with
+// RECON_GOLDEN_WRITE=1, its output is saved to testdata/golden; see
+// `make recon-goldens`); otherwise the saved goldens are used.
+func TestGolden(t *testing.T) {
+	bin := os.Getenv("RECON_BIN")
+	for _, fixture := range []string{"demo", "bad", "order"} {
+		t.Run(fixture, func(t *testing.T) {
+			golden := filepath.Join("testdata", "golden", fixture)
+			var want map[string]string
+			switch {
+			case bin != "":
+				want = runTool(t, bin, fixture)
+				if os.Getenv("RECON_GOLDEN_WRITE") == "1" {
+					writeDir(t, golden, want)
+				}
+			default:
+				if _, err := os.Stat(golden); os.IsNotExist(err) {
+					t.Skipf("MISSING GOLDENS: %s is not committed, so native output is NOT checked against recon@book-v1; run `make recon-goldens` and commit the result", golden)
+				}
+				want = readDir(t, golden)
+			}
+
+			dir := stageFixture(t, fixture)
+			out := filepath.Join(dir, "out")
+			if _, err := Run(filepath.Join(dir, "left.csv"), filepath.Join(dir, "right.csv"), out, Options{}); err != nil {
+				writeDir(t, out, map[string]string{"error.txt": ErrorText(err)})
+			}
+			got := readDir(t, out)
+
+			if strings.Join(sortedNames(got), ",") != strings.Join(sortedNames(want), ",") {
+				t.Fatalf("files\n got=%v\nwant=%v", sortedNames(got), sortedNames(want))
+			}
+			for name, w := range want {
+				if got[name] != w {
+					t.Errorf("%s\n got=%q\nwant=%q", name, got[name], w)
+				}
+			}
+		})
+	}
+}
+
+// stageFixture copies a fixture's inputs into a temp dir (as left.csv and
+// right.csv, like tree/inputs) with an empty out/ directory.
+func stageFixture(t *testing.T, fixture string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"left.csv", "right.csv"} {
+		b, err := os.ReadFile(filepath.Join("..", "..", "fixtures", fixture, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeDir(t, dir, map[string]string{name: string(b)})
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "out"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// runTool runs the pinned recon tool the way pipeline.Run does and returns
+// its work files, plus its combined output as error.txt when it fails.
+func runTool(t *testing.T, bin, fixture string) map[string]string {
+	t.Helper()
+	dir := stageFixture(t, fixture)
+	cmd := exec.Command(bin, "run", "--left", "left.csv", "--right", "right.csv", "--out", "out")
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("run %s: %v", bin, err)
+	}
+	files := readDir(t, filepath.Join(dir, "out"))
+	if err != nil {
+		files["error.txt"] = string(output)
+	}
+	return files
+}
+
+func writeDir(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(b), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReconcile_Mismatches(t *testing.T) {
+	left := &Table{Name: "left.csv", Header: []string{"ref", "amount", "memo"}, Rows: [][]string{
+		{"k2", "5.00", "x"}, {"k1", "1.00", "a"}, {"k3", "3.00", "c"},
+	}}
+	right := &Table{Name: "right.csv", Header: []string{"ref", "amount", "memo"}, Rows: [][]string{
+		{"k1", "1.00", "a"}, {"k2", "5.01", "y"}, {"k4", "4.00", "d"},
+	}}
+	res, err := Reconcile(left, right, Options{Key: []string{"ref"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := res.Summary()
+	if s != (Summary{LeftRows: 3, RightRows: 3, Matched: 1, LeftOnly: 1, RightOnly: 1, Mismatched: 1}) {
+		t.Fatalf("summary=%+v", s)
+	}
+	want := []Mismatch{{[]string{"k2"}, "amount", "5.00", "5.01"}, {[]string{"k2"}, "memo", "x", "y"}}
+	if !reflect.DeepEqual(res.Mismatched, want) {
+		t.Fatalf("mismatched=%+v", res.Mismatched)
+	}
+
+	dir := t.TempDir()
+	if err := res.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "mismatched.csv"))
+	if string(b) != "ref,field,left,right\nk2,amount,5.00,5.01\nk2,memo,x,y\n" {
+		t.Fatalf("mismatched.csv=%q", b)
+	}
+}
+
+func TestReconcile_BadData(t *testing.T) {
+	h := []string{"id", "amount"}
+	for _, tc := range []struct {
+		name        string
+		left, right [][]string
+		want        string
+	}{
+		{"duplicate", [][]string{{"a", "1"}, {"a", "2"}}, nil, `left.csv: row 3: duplicate key "a"`},
+		{"empty key", nil, [][]string{{"", "1"}}, "right.csv: row 2: empty key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Reconcile(&Table{Name: "left.csv", Header: h, Rows: tc.left},
+				&Table{Name: "right.csv", Header: h, Rows: tc.right}, Options{})
+			if err == nil || err.Error() != tc.want {
+				t.Fatalf("err=%v want %q", err, tc.want)
+			}
+		})
+	}
+	_, err := Reconcile(&Table{Header: []string{"ref"}}, &Table{Header: []string{"ref"}}, Options{})
+	if err == nil || !strings.Contains(err.Error(), `column "id" not in`) {
+		t.Fatalf("err=%v", err)
+	}
+}
+
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]string{}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[e.Name()] = string(b)
+	}
+	return m
+}
+
+func sortedNames(m map[string]string) []string {
+	var names []string
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestReconcile_Spec(t *testing.T) {
+	left := &Table{Name: "bank.csv", Header: []string{"date", "id", "amount", "memo"}, Rows: [][]string{
+		{"2026-01-01", "a1", "10.00", "coffee"},
+		{"2026-01-02", "a1", "20.00", "books"},
+		{"2026-01-03", "a3", "30.00", "groceries"},
+	}}
+	right := &Table{Name: "ledger.csv", Header: []string{"txn_id", "amount", "date", "note", "posted_by"}, Rows: [][]string{
+		{"a1", "10.00", "2026-01-01", "COFFEE", "x"},
+		{"a1", "21.00", "2026-01-02", "books", "y"},
+		{"b9", "99.00", "2026-01-09", "unknown", "z"},
+	}}
+	opts := Options{
+		Key:         []string{"id", "date"},
+		Ignore:      []string{"memo"},
+		RenameRight: map[string]string{"txn_id": "id", "note": "memo"},
+	}
+	res, err := Reconcile(left, right, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// memo/note differs for a1@01-01 but is ignored; posted_by is not shared.
+	if s := res.Summary(); s != (Summary{LeftRows: 3, RightRows: 3, Matched: 1, LeftOnly: 1, RightOnly: 1, Mismatched: 1}) {
+		t.Fatalf("summary=%+v", s)
+	}
+	want := []Mismatch{{[]string{"a1", "2026-01-02"}, "amount", "20.00", "21.00"}}
+	if !reflect.DeepEqual(res.Mismatched, want) {
+		t.Fatalf("mismatched=%+v", res.Mismatched)
+	}
+
+	dir := t.TempDir()
+	if err := res.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	got := readDir(t, dir)
+	if got["mismatched.csv"] != "id,date,field,left,right\na1,2026-01-02,amount,20.00,21.00\n" {
+		t.Fatalf("mismatched.csv=%q", got["mismatched.csv"])
+	}
+	if got["right_only.csv"] != "txn_id,amount,date,note,posted_by\nb9,99.00,2026-01-09,unknown,z\n" {
+		t.Fatalf("right_only.csv=%q", got["right_only.csv"])
+	}
+
+	// Explicit compare columns limit the comparison.
+	opts.Compare = []string{"date"}
+	if res, err := Reconcile(left, right, opts); err != nil || len(res.Mismatched) != 0 {
+		t.Fatalf("compare=[date]: mismatched=%v err=%v", res.Mismatched, err)
+	}
+	// A key column missing on one side is an error, not a silent miss.
+	opts.RenameRight = nil
+	if _, err := Reconcile(left, right, opts); err == nil || !strings.Contains(err.Error(), `column "id" not in ledger.csv header`) {
+		t.Fatalf("err=%v", err)
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	o, err := LoadSpec(write("ok.json", `{"key":["id"],"ignore":["memo"],"rename_right":{"txn_id":"id"}}`))
+	if err != nil || !reflect.DeepEqual(o, Options{Key: []string{"id"}, Ignore: []string{"memo"}, RenameRight: map[string]string{"txn_id": "id"}}) {
+		t.Fatalf("o=%+v err=%v", o, err)
+	}
+	// abs/rel may be numbers or strings; either way they stay decimal text.
+	o, err = LoadSpec(write("tol.json", `{"tolerances":{"amount":{"abs":0.01,"rel":"0.001"},"date":{"days":2}}}`))
+	if err != nil || o.Tolerances["amount"].Abs != "0.01" || o.Tolerances["amount"].Rel != "0.001" || *o.Tolerances["date"].Days != 2 {
+		t.Fatalf("o=%+v err=%v", o, err)
+	}
+	for name, body := range map[string]string{
+		"typo.json":     `{"keys":["id"]}`,
+		"badtol.json":   `{"tolerances":{"amount":{"abs":"0.01","days":1}}}`,
+		"conflict.json": `{"key":["id"],"ignore":["id"]}`,
+		"twice.json":    `{"compare":["amount","amount"]}`,
+		"spec.yaml":     "key: [id]\n",
+	} {
+		if _, err := LoadSpec(write(name, body)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReconcile_Tolerances(t *testing.T) {
+	h := []string{"id", "date", "amount", "memo"}
+	left := &Table{Name: "bank.csv", Header: h, Rows: [][]string{
+		{"a1", "2026-01-01", "1.005", "Coffee  Shop"}, // exactly 0.01 apart: a float would say 0.010000000000000009
+		{"a2", "2026-01-01", "1000.00", "rent"},
+		{"a3", "2026-01-01", "10.00", "x"},
+		{"a4", "2026-01-01", "10.00", "x"},
+		{"a5", "2026-01-01", "10.00", "x"},
+		{"a6", "2026-01-01", "10.00", "x"},
+	}}
+	right := &Table{Name: "ledger.csv", Header: h, Rows: [][]string{
+		{"a1", "2026-01-01", "1.015", " coffee shop"},
+		{"a2", "2026-01-03", "1000.90", "rent"},
+		{"a3", "2026-01-04", "10.00", "x"}, // 3 days: outside the window
+		{"a4", "2026-01-02", "10.02", "x"}, // date ok, amount not
+		{"a5", "2026-01-01", "10.00", "x"}, // exact
+		{"a6", "2026-01-01", "ten", "x"},   // not a decimal
+	}}
+	two := 2
+	opts := Options{Tolerances: map[string]Tolerance{
+		"amount": {Abs: "0.01", Rel: "0.001"},
+		"date":   {Days: &two},
+		"memo":   {Fold: true},
+	}}
+	res, err := Reconcile(left, right, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := res.Summary(); s.Matched != 1 || s.WithinTolerance == nil || *s.WithinTolerance != 2 || s.Mismatched != 3 {
+		t.Fatalf("summary=%+v", s)
+	}
+
+	dir := t.TempDir()
+	if err := res.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	got := readDir(t, dir)
+	wantTol := "id,field,left,right,rule\n" +
+		"a1,amount,1.005,1.015,abs<=0.01\n" +
+		"a1,memo,Coffee  Shop,\" coffee shop\",fold\n" +
+		"a2,date,2026-01-01,2026-01-03,days<=2\n" +
+		"a2,amount,1000.00,1000.90,rel<=0.001\n"
+	if got["matched_within_tolerance.csv"] != wantTol {
+		t.Fatalf("matched_within_tolerance.csv=%q", got["matched_within_tolerance.csv"])
+	}
+	wantMis := "id,field,left,right\n" +
+		"a3,date,2026-01-01,2026-01-04\n" +
+		"a4,amount,10.00,10.02\n" +
+		"a6,amount,10.00,ten\n"
+	if got["mismatched.csv"] != wantMis {
+		t.Fatalf("mismatched.csv=%q", got["mismatched.csv"])
+	}
+	if !strings.Contains(got["summary.json"], `"matched_within_tolerance": 2,`) {
+		t.Fatalf("summary.json=%s", got["summary.json"])
+	}
+
+	for name, bad := range map[string]Options{
+		"two kinds":    {Tolerances: map[string]Tolerance{"amount": {Abs: "0.01", Fold: true}}},
+		"negative":     {Tolerances: map[string]Tolerance{"amount": {Abs: "-1"}}},
+		"not decimal":  {Tolerances: map[string]Tolerance{"amount": {Rel: "1e-3"}}},
+		"key column":   {Tolerances: map[string]Tolerance{"id": {Fold: true}}},
+		"not compared": {Ignore: []string{"memo"}, Tolerances: map[string]Tolerance{"memo": {Fold: true}}},
+	} {
+		if _, err := Reconcile(left, right, bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
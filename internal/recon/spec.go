@@ -0,0 +1,89 @@
+package recon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// LoadSpec reads a recon spec: Options as JSON, e.g.
+//
+//	{
+//	  "key": ["txn_id", "date"],
+//	  "compare": ["amount"],
+//	  "ignore": ["description"],
+//	  "rename_right": {"id": "txn_id"},
+//	  "tolerances": {"amount": {"abs": "0.01"}, "date": {"days": 2}}
+//	}
+//
+// Unknown fields are rejected so a typo cannot silently change the rules.
+// YAML specs are not supported (the module has no YAML dependency).
+func LoadSpec(path string) (Options, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return Options{}, fmt.Errorf("recon spec %s: YAML is not supported; write the spec as JSON", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Options{}, err
+	}
+	var o Options
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&o); err != nil {
+		return Options{}, fmt.Errorf("recon spec %s: %w", path, err)
+	}
+	if err := o.validate(); err != nil {
+		return Options{}, fmt.Errorf("recon spec %s: %w", path, err)
+	}
+	return o, nil
+}
+
+// toleranceColumns returns the columns of a tolerance map in order.
+func toleranceColumns(m map[string]Tolerance) []string {
+	names := make([]string, 0, len(m))
+	for c := range m {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate rejects contradictory options.
+func (o Options) validate() error {
+	for _, list := range []struct {
+		name string
+		cols []string
+	}{{"key", o.Key}, {"compare", o.Compare}, {"ignore", o.Ignore}} {
+		for i, c := range list.cols {
+			if c == "" {
+				return fmt.Errorf("%s: empty column name", list.name)
+			}
+			if slices.Contains(list.cols[:i], c) {
+				return fmt.Errorf("%s: column %q listed twice", list.name, c)
+			}
+		}
+	}
+	for _, c := range toleranceColumns(o.Tolerances) {
+		if slices.Contains(o.Ignore, c) {
+			return fmt.Errorf("tolerance for ignored column %q", c)
+		}
+		if err := o.Tolerances[c].validate(); err != nil {
+			return fmt.Errorf("tolerances: %s: %w", c, err)
+		}
+	}
+	for _, c := range o.Ignore {
+		if slices.Contains(o.Key, c) {
+			return fmt.Errorf("column %q is both a key and ignored", c)
+		}
+		if slices.Contains(o.Compare, c) {
+			return fmt.Errorf("column %q is both compared and ignored", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package recon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultDateLayout is the date layout used when Tolerance.Layout is empty.
+const DefaultDateLayout = "2006-01-02"
+
+// Tolerance lets a compared column differ and still match. Set exactly one
+// kind of rule:
+//
+//	{"abs": "0.01", "rel": "0.001"}  amounts: |l-r| <= abs, or <= rel*max(|l|,|r|)
+//	{"days": 2}                      dates at most 2 days apart (Layout, default 2006-01-02)
+//	{"fold": true}                   equal ignoring case and runs of whitespace
+//
+// Amounts are compared as exact decimals (math/big), never as floats; abs and
+// rel may be JSON strings or numbers and are read as decimal text.
+type Tolerance struct {
+	Abs    json.Number `json:"abs,omitempty"`
+	Rel    json.Number `json:"rel,omitempty"`
+	Days   *int        `json:"days,omitempty"`
+	Layout string      `json:"layout,omitempty"`
+	Fold   bool        `json:"fold,omitempty"`
+}
+
+// Tolerated is a differing field accepted by a tolerance rule.
+type Tolerated struct {
+	Mismatch
+	Rule string // the rule that accepted it, e.g. "abs<=0.01"
+}
+
+// decimalRE accepts plain decimals: optional sign, digits, optional fraction.
+var decimalRE = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+
+// parseDecimal parses a plain decimal exactly.
+func parseDecimal(s string) (*big.Rat, bool) {
+	s = strings.TrimSpace(s)
+	if !decimalRE.MatchString(s) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(s)
+}
+
+// validate checks that the rule is well formed.
+func (t Tolerance) validate() error {
+	kinds := 0
+	if t.Abs != "" || t.Rel != "" {
+		kinds++
+		for _, v := range []json.Number{t.Abs, t.Rel} {
+			if v == "" {
+				continue
+			}
+			d, ok := parseDecimal(string(v))
+			if !ok || d.Sign() < 0 {
+				return fmt.Errorf("%q is not a non-negative decimal", string(v))
+			}
+		}
+	}
+	if t.Days != nil {
+		kinds++
+		if *t.Days < 0 {
+			return fmt.Errorf("days must not be negative")
+		}
+	}
+	if t.Layout != "" && t.Days == nil {
+		return fmt.Errorf("layout needs days")
+	}
+	if t.Fold {
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("set exactly one of abs/rel, days or fold")
+	}
+	return nil
+}
+
+// accept reports whether two differing values are within the rule, and the
+// rule text recorded for them.
+func (t Tolerance) accept(l, r string) (string, bool) {
+	switch {
+	case t.Fold:
+		return "fold", foldSpace(l) == foldSpace(r)
+
+	case t.Days != nil:
+		layout := t.Layout
+		if layout == "" {
+			layout = DefaultDateLayout
+		}
+		lt, err1 := time.Parse(layout, strings.TrimSpace(l))
+		rt, err2 := time.Parse(layout, strings.TrimSpace(r))
+		if err1 != nil || err2 != nil {
+			return "", false
+		}
+		d := lt.Sub(rt)
+		if d < 0 {
+			d = -d
+		}
+		return fmt.Sprintf("days<=%d", *t.Days), d <= time.Duration(*t.Days)*24*time.Hour
+	}
+
+	lv, ok1 := parseDecimal(l)
+	rv, ok2 := parseDecimal(r)
+	if !ok1 || !ok2 {
+		return "", false
+	}
+	diff := new(big.Rat).Sub(lv, rv)
+	diff.Abs(diff)
+	if t.Abs != "" {
+		abs, _ := parseDecimal(string(t.Abs))
+		if diff.Cmp(abs) <= 0 {
+			return "abs<=" + string(t.Abs), true
+		}
+	}
+	if t.Rel != "" {
+		rel, _ := parseDecimal(string(t.Rel))
+		base := new(big.Rat).Abs(lv)
+		if ra := new(big.Rat).Abs(rv); ra.Cmp(base) > 0 {
+			base = ra
+		}
+		if diff.Cmp(base.Mul(base, rel)) <= 0 {
+			return "rel<=" + string(t.Rel), true
+		}
+	}
+	return "", false
+}
+
+// foldSpace lower-cases s and collapses runs of whitespace to one space.
+func foldSpace(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
+)
+
+// claimName is the in-flight claim object, next to the completion markers.
+const claimName = "_RUNNING.json"
+
+// errRunInProgress means another delivery holds a live claim on the run.
+var errRunInProgress = errors.New("run in progress")
+
+type claimBody struct {
+	RunID string `json:"run_id"`
+	Owner string `json:"owner"`
+}
+
+// runClaim is a claim this instance holds on out/<run_id>/_RUNNING.json.
+type runClaim struct {
+	store      gcsutil.Conditional
+	object     string
+	generation string
+}
+
+// acquireClaim creates object only if it does not exist (ifGenerationMatch=0),
+// so exactly one concurrent delivery wins. A claim older than lease (by the
+// store's updated time) belongs to a crashed instance and is taken over at its
+// generation. Otherwise errRunInProgress is returned.
+func acquireClaim(ctx context.Context, store gcsutil.Conditional, object, runID, tmp string, lease time.Duration) (*runClaim, error) {
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(claimBody{RunID: runID, Owner: owner}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	src := filepathOS(tmp, claimName)
+	if err := os.WriteFile(src, append(b, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+
+	// One retry covers a claim released between our create and our stat.
+	for i := 0; i < 2; i++ {
+		gen, err := store.PutIfGeneration(ctx, object, src, "0")
+		if err == nil {
+			return &runClaim{store: store, object: object, generation: gen}, nil
+		}
+		if !errors.Is(err, gcsutil.ErrPreconditionFailed) {
+			return nil, err
+		}
+
+		attrs, err := store.Stat(ctx, object)
+		if errors.Is(err, gcsutil.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// A retried create whose first response was lost reports 412 for our own claim.
+		held := filepathOS(tmp, "held-"+claimName)
+		if err := store.GetGeneration(ctx, object, attrs.Generation, held); err == nil {
+			var cur claimBody
+			if b, err := os.ReadFile(held); err == nil && json.Unmarshal(b, &cur) == nil && cur.Owner == owner {
+				return &runClaim{store: store, object: object, generation: attrs.Generation}, nil
+			}
+		}
+
+		age := time.Since(attrs.Updated)
+		if age < lease {
+			return nil, errRunInProgress
+		}
+		gen, err = store.PutIfGeneration(ctx, object, src, attrs.Generation)
+		if errors.Is(err, gcsutil.ErrPreconditionFailed) {
+			return nil, errRunInProgress
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stdout, "claim_takeover: run_id=%s expired claim age=%s\n", runID, age.Round(time.Second))
+		return &runClaim{store: store, object: object, generation: gen}, nil
+	}
+	return nil, errRunInProgress
+}
+
+// release deletes the claim if we still hold it. It runs after the handler
+// context may have ended, so it uses its own deadline.
+func (c *runClaim) release(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	if err := c.store.DeleteIfGeneration(ctx, c.object, c.generation); err != nil {
+		// A taken-over claim is no longer ours; a leftover claim expires with its lease.
+		fmt.Fprintf(os.Stdout, "claim_release_error: %s: %v\n", c.object, err)
+	}
+}
+
+func newOwner() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+)
+
+const (
+	structuredContentType = "application/cloudevents+json"
+	batchContentType      = "application/cloudevents-batch+json"
+)
+
+// structuredEvent is a CloudEvent in structured content mode: attributes and
+// data in one JSON object instead of Ce-* headers.
+type structuredEvent struct {
+	SpecVersion string          `json:"specversion"`
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Source      string          `json:"source"`
+	Subject     string          `json:"subject,omitempty"`
+	Data        json.RawMessage `json:"data"`
+	DataBase64  []byte          `json:"data_base64"`
+}
+
+// payload returns the event data as the body the contract parses.
+func (e structuredEvent) payload() []byte {
+	if len(e.DataBase64) > 0 {
+		return e.DataBase64
+	}
+	return e.Data
+}
+
+func parseStructured(b []byte) (structuredEvent, error) {
+	var ev structuredEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return ev, fmt.Errorf("cloudevent: malformed structured event: %v", err)
+	}
+	if ev.Type == "" || ev.Source == "" {
+		return ev, errors.New("cloudevent: missing type or source")
+	}
+	return ev, nil
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// batchOutcome reports what happened to one event of a batch.
+type batchOutcome struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Source string `json:"source,omitempty"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// batchTimeout bounds a whole batch delivery, so it is answered within the
+// time one event may take (tests shorten it).
+var batchTimeout = runTimeout
+
+// serveBatch handles a batch-mode delivery: each event is processed on its
+// own and the response lists per-event outcomes. The batch status is 500 if
+// any event needs a retry for an internal error, else 429 if any run was in
+// progress elsewhere, else 200. Redelivered events that already completed
+// are ACKed by the marker check, so retrying a whole batch is safe.
+//
+// The events share one batchTimeout deadline; events not started before it
+// report 500 and are retried with the batch.
+func serveBatch(w http.ResponseWriter, ctx context.Context, cfg config, body []byte) {
+	ctx, cancel := context.WithTimeout(ctx, batchTimeout)
+	defer cancel()
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		// Like a malformed single event: ACK so it is not redelivered forever.
+		fmt.Fprintf(os.Stdout, "event_contract_error: cloudevent: malformed batch: %v\n", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	report := struct {
+		Events []batchOutcome `json:"events"`
+	}{Events: make([]batchOutcome, 0, len(raw))}
+	status := http.StatusOK
+	for i, b := range raw {
+		out := batchOutcome{Index: i}
+		ev, err := parseStructured(b)
+		out.ID, out.Type, out.Source = ev.ID, ev.Type, ev.Source
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "event_contract_error: %v\n", err)
+			out.Status, out.Detail = http.StatusNoContent, err.Error()
+		} else if ctx.Err() != nil {
+			fmt.Fprintf(os.Stdout, "batch_deadline: event %d (%s) not started\n", i, ev.ID)
+			out.Status, out.Detail = http.StatusInternalServerError, "not started: batch deadline exceeded"
+		} else {
+			out.Status, out.Detail = handleEvent(ctx, cfg, ev.Type, ev.payload())
+		}
+
+		if worseStatus(status, out.Status) != status {
+			status = out.Status
+			if status >= 500 {
+				status = http.StatusInternalServerError
+			}
+		}
+		report.Events = append(report.Events, out)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+}
@@ -11,9 +11,11 @@ type completionMarker struct {
 	RunID  string `json:"run_id"`
 	Status string `json:"status"`
 	Error  string `json:"error,omitempty"`
+	// InputGenerations records the input object generations the run used.
+	InputGenerations map[string]string `json:"input_generations,omitempty"`
 }
 
-func writeCompletionMarker(runDir, runID string, runErr error) error {
+func writeCompletionMarker(runDir, runID string, runErr error, gens map[string]string) error {
 	if strings.TrimSpace(runDir) == "" {
 		// Nothing to write; treat as internal error so the event can be retried.
 		return fmt.Errorf("missing run dir for completion marker")
@@ -32,9 +34,10 @@ func writeCompletionMarker(runDir, runID string, runErr error) error {
 	}
 
 	m := completionMarker{
-		RunID:  runID,
-		Status: status,
-		Error:  errSummary,
+		RunID:            runID,
+		Status:           status,
+		Error:            errSummary,
+		InputGenerations: gens,
 	}
 
 	b, err := json.MarshalIndent(m, "", "  ")
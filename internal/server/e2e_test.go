@@ -0,0 +1,855 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsfake"
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/pipeline"
+	contract "github.com/nicholaskarlson/proof-first-event-contracts/contract"
+)
+
+// When FAKE_TOOLS=1 the test binary stands in for the pinned recon and
+// auditpack tools, so the full handler runs without them installed.
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_TOOLS") == "1" && len(os.Args) > 1 {
+		os.Exit(fakeTool(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func fakeTool(args []string) int {
+	fset := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	left := fset.String("left", "", "")
+	right := fset.String("right", "", "")
+	out := fset.String("out", "", "")
+	in := fset.String("in", "", "")
+	label := fset.String("label", "", "")
+	pack := fset.String("pack", "", "")
+	if err := fset.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	switch {
+	case args[0] == "run" && *left != "": // recon run
+		lh, ln := headerAndRows(*left)
+		rh, rn := headerAndRows(*right)
+		if lh != rh {
+			fmt.Fprintf(os.Stderr, "recon: header mismatch: %q vs %q\n", lh, rh)
+			return 1
+		}
+		summary := fmt.Sprintf("{\n  \"left_rows\": %d,\n  \"right_rows\": %d\n}\n", ln, rn)
+		if err := os.WriteFile(filepath.Join(*out, "summary.json"), []byte(summary), 0o644); err != nil {
+			return 1
+		}
+		return 0
+
+	case args[0] == "run": // auditpack run
+		var lines []string
+		_ = filepath.WalkDir(*in, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(*in, p)
+			sum := sha256.Sum256(b)
+			lines = append(lines, hex.EncodeToString(sum[:])+"  "+filepath.ToSlash(rel))
+			return nil
+		})
+		sort.Strings(lines)
+		manifest := "label: " + *label + "\n" + strings.Join(lines, "\n") + "\n"
+		if err := os.WriteFile(filepath.Join(*out, "manifest.txt"), []byte(manifest), 0o644); err != nil {
+			return 1
+		}
+		return 0
+
+	case args[0] == "verify":
+		if _, err := os.Stat(filepath.Join(*pack, "manifest.txt")); err != nil {
+			return 1
+		}
+		return 0
+	}
+	return 2
+}
+
+func headerAndRows(p string) (string, int) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	header, n := "", -1
+	for sc.Scan() {
+		if n < 0 {
+			header = sc.Text()
+		}
+		n++
+	}
+	return header, n
+}
+
+type e2eEnv struct {
+	fake    *gcsfake.Server
+	cfg     config
+	handler http.Handler
+}
+
+func newE2E(t *testing.T) *e2eEnv {
+	t.Helper()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+	t.Setenv("FAKE_TOOLS", "1")
+	t.Setenv("GCP_ACCESS_TOKEN", "tok")
+	t.Setenv("GCS_RETRY_BACKOFF", "1ms")
+
+	fake := gcsfake.New()
+	fake.Token = "tok"
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = fake.Transport()
+	t.Cleanup(func() {
+		http.DefaultClient.Transport = old
+		fake.Close()
+	})
+
+	cfg := config{
+		inPrefix:     "in/",
+		outPrefix:    "out/",
+		inBucket:     "inbucket",
+		outBucket:    "outbucket",
+		reconBin:     exe,
+		auditpackBin: exe,
+		runLease:     defaultRunLease,
+	}
+	return &e2eEnv{fake: fake, cfg: cfg, handler: newHandler(cfg)}
+}
+
+func (e *e2eEnv) putFixture(t *testing.T, runID, fixture string) {
+	t.Helper()
+	for _, name := range []string{"left.csv", "right.csv"} {
+		b, err := os.ReadFile(filepath.Join("..", "..", "fixtures", fixture, name))
+		if err != nil {
+			t.Fatalf("read fixture: %v", err)
+		}
+		e.fake.PutObject("inbucket", "in/"+runID+"/"+name, b)
+	}
+}
+
+func (e *e2eEnv) post(ceType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Ce-Type", ceType)
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func finalizeEvent(runID string) string {
+	return `{"bucket":"inbucket","name":"in%2F` + runID + `%2Fright.csv"}`
+}
+
+func TestE2E_SuccessUploadsExactObjectSet(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+
+	// Transient faults on the first download and first upload must be retried.
+	e.fake.AddFault(gcsfake.Fault{Object: "in/demo/left.csv", Status: http.StatusServiceUnavailable})
+	e.fake.AddFault(gcsfake.Fault{Method: http.MethodPost, Status: http.StatusTooManyRequests})
+
+	rec := e.post(contract.TypeFinalized, finalizeEvent("demo"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	got := e.fake.Names("outbucket", "out/demo/")
+	want := []string{
+		"out/demo/_SUCCESS.json",
+		"out/demo/pack/manifest.txt",
+		"out/demo/tree/inputs/left.csv",
+		"out/demo/tree/inputs/right.csv",
+		"out/demo/tree/sources.json",
+		"out/demo/tree/work/summary.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("objects\n got=%v\nwant=%v", got, want)
+	}
+
+	marker, _ := e.fake.Object("outbucket", "out/demo/_SUCCESS.json")
+	wantMarker := "{\n  \"run_id\": \"demo\",\n  \"status\": \"success\",\n" +
+		"  \"input_generations\": {\n    \"left.csv\": \"1\",\n    \"right.csv\": \"2\"\n  }\n}\n"
+	if string(marker) != wantMarker {
+		t.Fatalf("marker=%q", marker)
+	}
+
+	// The pack attests to the verified input digests.
+	sources, _ := e.fake.Object("outbucket", "out/demo/tree/sources.json")
+	left, _ := e.fake.Object("inbucket", "in/demo/left.csv")
+	if !strings.Contains(string(sources), `"object": "in/demo/left.csv"`) ||
+		!strings.Contains(string(sources), `"crc32c": "`+gcsfake.CRC32C(left)+`"`) {
+		t.Fatalf("sources.json=%s", sources)
+	}
+
+	// The marker must be the last upload.
+	var uploads []string
+	for _, l := range e.fake.Log() {
+		if strings.HasPrefix(l, "upload outbucket/") {
+			uploads = append(uploads, l)
+		}
+	}
+	if len(uploads) == 0 || uploads[len(uploads)-1] != "upload outbucket/out/demo/_SUCCESS.json" {
+		t.Fatalf("marker not uploaded last: %v", uploads)
+	}
+
+	// Replay: the marker exists, so nothing is downloaded or uploaded again.
+	before := len(e.fake.Log())
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusNoContent {
+		t.Fatalf("replay status=%d", rec.Code)
+	}
+	for _, l := range e.fake.Log()[before:] {
+		if !strings.HasPrefix(l, "meta ") {
+			t.Fatalf("replay did work: %v", e.fake.Log()[before:])
+		}
+	}
+}
+
+func TestE2E_BadDataWritesErrorMarker(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "baddemo", "bad")
+
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("baddemo")); rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	got := e.fake.Names("outbucket", "out/baddemo/")
+	want := []string{
+		"out/baddemo/_ERROR.json",
+		"out/baddemo/pack/manifest.txt",
+		"out/baddemo/tree/error.txt",
+		"out/baddemo/tree/inputs/left.csv",
+		"out/baddemo/tree/inputs/right.csv",
+		"out/baddemo/tree/sources.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("objects\n got=%v\nwant=%v", got, want)
+	}
+}
+
+func TestE2E_NativeEngine(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.reconEngine = pipeline.EngineNative
+	e.cfg.reconBin = "/nonexistent/recon" // must not be used
+	e.handler = newHandler(e.cfg)
+	e.putFixture(t, "demo", "demo")
+	e.putFixture(t, "baddemo", "bad")
+
+	for _, runID := range []string{"demo", "baddemo"} {
+		if rec := e.post(contract.TypeFinalized, finalizeEvent(runID)); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: status=%d body=%s", runID, rec.Code, rec.Body.String())
+		}
+	}
+	got := e.fake.Names("outbucket", "out/demo/tree/work/")
+	want := []string{
+		"out/demo/tree/work/left_only.csv",
+		"out/demo/tree/work/matched.csv",
+		"out/demo/tree/work/mismatched.csv",
+		"out/demo/tree/work/right_only.csv",
+		"out/demo/tree/work/summary.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("objects\n got=%v\nwant=%v", got, want)
+	}
+	errTxt, _ := e.fake.Object("outbucket", "out/baddemo/tree/error.txt")
+	if !strings.HasPrefix(string(errTxt), "recon: header mismatch: left.csv has ") {
+		t.Fatalf("error.txt=%q", errTxt)
+	}
+	if _, ok := e.fake.Object("outbucket", "out/baddemo/_ERROR.json"); !ok {
+		t.Fatal("missing _ERROR.json")
+	}
+}
+
+func TestE2E_CorruptDownloadIsRetryable(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	t.Setenv("GCS_RETRIES", "1")
+
+	// After: 1 lets the generation lookup through; the media download is corrupted.
+	e.fake.AddFault(gcsfake.Fault{Object: "in/demo/right.csv", Corrupt: true, After: 1})
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status=%d want 500", rec.Code)
+	}
+	if got := e.fake.Names("outbucket", ""); len(got) != 0 {
+		t.Fatalf("expected no outputs, got %v", got)
+	}
+}
+
+func TestE2E_InternalErrorIsRetryable(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	t.Setenv("GCS_RETRIES", "1")
+
+	e.fake.AddFault(gcsfake.Fault{Object: "in/demo/right.csv", Status: http.StatusServiceUnavailable})
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status=%d want 500", rec.Code)
+	}
+	if got := e.fake.Names("outbucket", ""); len(got) != 0 {
+		t.Fatalf("expected no outputs, got %v", got)
+	}
+}
+
+func generationEvent(runID, generation string) string {
+	return `{"bucket":"inbucket","name":"in%2F` + runID + `%2Fright.csv","generation":"` + generation + `"}`
+}
+
+func TestE2E_EventGenerationPinsRightInput(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	gen := strconv.FormatInt(e.fake.Generation("inbucket", "in/demo/right.csv"), 10)
+
+	if rec := e.post(contract.TypeFinalized, generationEvent("demo", gen)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	sources, _ := e.fake.Object("outbucket", "out/demo/tree/sources.json")
+	if !strings.Contains(string(sources), `"generation": "`+gen+`"`) {
+		t.Fatalf("sources.json=%s", sources)
+	}
+	// The event supplied right.csv's generation, so only left.csv is looked up.
+	for _, l := range e.fake.Log() {
+		if l == "meta inbucket/in/demo/right.csv" {
+			t.Fatalf("right.csv generation looked up despite event: %v", e.fake.Log())
+		}
+	}
+}
+
+func TestE2E_StaleGenerationIsAcked(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	stale := strconv.FormatInt(e.fake.Generation("inbucket", "in/demo/right.csv"), 10)
+
+	// right.csv is overwritten before the first event is delivered.
+	right, _ := e.fake.Object("inbucket", "in/demo/right.csv")
+	e.fake.PutObject("inbucket", "in/demo/right.csv", right)
+
+	if rec := e.post(contract.TypeFinalized, generationEvent("demo", stale)); rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if got := e.fake.Names("outbucket", ""); len(got) != 0 {
+		t.Fatalf("expected no outputs, got %v", got)
+	}
+}
+
+func TestE2E_RejectLeftAfterRight(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	e.cfg.rejectLeftAfterRight = true
+	e.handler = newHandler(e.cfg)
+
+	// left.csv is rewritten after right.csv was finalized.
+	left, _ := e.fake.Object("inbucket", "in/demo/left.csv")
+	e.fake.PutObject("inbucket", "in/demo/left.csv", left)
+
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	got := e.fake.Names("outbucket", "out/demo/")
+	if !reflect.DeepEqual(got, []string{"out/demo/_ERROR.json"}) {
+		t.Fatalf("objects=%v", got)
+	}
+	marker, _ := e.fake.Object("outbucket", "out/demo/_ERROR.json")
+	if !strings.Contains(string(marker), "left.csv generation 3 is newer than right.csv generation 2") {
+		t.Fatalf("marker=%s", marker)
+	}
+}
+
+// readyManifest lists the stored inputs of runID, optionally skewing one sha256.
+func (e *e2eEnv) readyManifest(t *testing.T, runID, badSHA string) []byte {
+	t.Helper()
+	m := runManifest{}
+	for _, name := range []string{"left.csv", "right.csv"} {
+		b, _ := e.fake.Object("inbucket", "in/"+runID+"/"+name)
+		size := int64(len(b))
+		sum := sha256.Sum256(b)
+		in := manifestInput{Name: name, Size: &size, SHA256: hex.EncodeToString(sum[:])}
+		if name == badSHA {
+			in.SHA256 = strings.Repeat("0", 64)
+		}
+		m.Inputs = append(m.Inputs, in)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestE2E_ManifestTrigger(t *testing.T) {
+	readyEvent := `{"bucket":"inbucket","name":"in/demo/_READY.json"}`
+	cases := []struct {
+		name   string
+		setup  func(e *e2eEnv) []byte // returns the manifest
+		marker string
+		detail string
+	}{
+		{"verified", func(e *e2eEnv) []byte { return e.readyManifest(t, "demo", "") },
+			"out/demo/_SUCCESS.json", ""},
+		{"digest_mismatch", func(e *e2eEnv) []byte { return e.readyManifest(t, "demo", "right.csv") },
+			"out/demo/_ERROR.json", "in/demo/right.csv: sha256 "},
+		{"missing_input", func(e *e2eEnv) []byte {
+			m := e.readyManifest(t, "demo", "")
+			e.fake.DeleteObject("inbucket", "in/demo/right.csv")
+			return m
+		}, "out/demo/_ERROR.json", "_READY.json lists right.csv but in/demo/right.csv does not exist"},
+		{"bad_manifest", func(e *e2eEnv) []byte { return []byte(`{"inputs":[{"name":"left.csv","size":1,"sha256":"00"}]}`) },
+			"out/demo/_ERROR.json", "manifest does not list right.csv"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newE2E(t)
+			e.cfg.triggerMode = triggerManifest
+			e.handler = newHandler(e.cfg)
+			e.putFixture(t, "demo", "demo")
+
+			// right.csv no longer triggers; only the manifest does.
+			if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusNoContent {
+				t.Fatalf("right.csv status=%d", rec.Code)
+			}
+			if got := e.fake.Names("outbucket", ""); len(got) != 0 {
+				t.Fatalf("right.csv triggered a run: %v", got)
+			}
+
+			e.fake.PutObject("inbucket", "in/demo/_READY.json", tc.setup(e))
+			if rec := e.post(contract.TypeFinalized, readyEvent); rec.Code != http.StatusNoContent {
+				t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+			}
+			marker, ok := e.fake.Object("outbucket", tc.marker)
+			if !ok {
+				t.Fatalf("missing %s; objects=%v", tc.marker, e.fake.Names("outbucket", ""))
+			}
+			if !strings.Contains(string(marker), tc.detail) {
+				t.Fatalf("marker=%s", marker)
+			}
+		})
+	}
+}
+
+func TestE2E_LiveClaimDefersDelivery(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	e.fake.PutObject("outbucket", "out/demo/_RUNNING.json", []byte(`{"run_id":"demo","owner":"other"}`))
+
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status=%d want 429", rec.Code)
+	}
+	if got := e.fake.Names("outbucket", ""); !reflect.DeepEqual(got, []string{"out/demo/_RUNNING.json"}) {
+		t.Fatalf("objects=%v", got)
+	}
+}
+
+func TestE2E_ExpiredClaimIsTakenOver(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	e.fake.SetClock(func() time.Time { return time.Now().Add(-time.Hour) })
+	e.fake.PutObject("outbucket", "out/demo/_RUNNING.json", []byte(`{"run_id":"demo","owner":"crashed"}`))
+	e.fake.SetClock(time.Now)
+
+	if rec := e.post(contract.TypeFinalized, finalizeEvent("demo")); rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if _, ok := e.fake.Object("outbucket", "out/demo/_SUCCESS.json"); !ok {
+		t.Fatalf("run did not complete: %v", e.fake.Names("outbucket", ""))
+	}
+	if _, ok := e.fake.Object("outbucket", "out/demo/_RUNNING.json"); ok {
+		t.Fatalf("claim not released")
+	}
+}
+
+func TestE2E_ConcurrentDeliveriesRunOnce(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	// Slow the first download so the deliveries overlap.
+	e.fake.AddFault(gcsfake.Fault{Object: "in/demo/left.csv", Delay: 50 * time.Millisecond, Times: 2})
+
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = e.post(contract.TypeFinalized, finalizeEvent("demo")).Code
+		}(i)
+	}
+	wg.Wait()
+
+	for _, c := range codes {
+		if c != http.StatusNoContent && c != http.StatusTooManyRequests {
+			t.Fatalf("codes=%v", codes)
+		}
+	}
+	n := 0
+	for _, l := range e.fake.Log() {
+		if l == "upload outbucket/out/demo/_SUCCESS.json" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("marker uploaded %d times; codes=%v", n, codes)
+	}
+}
+
+func TestE2E_BothTriggerRunsWhenLastInputArrives(t *testing.T) {
+	e := newE2E(t)
+	e.cfg.triggerMode = triggerBoth
+	e.handler = newHandler(e.cfg)
+	e.putFixture(t, "demo", "demo")
+	right, _ := e.fake.Object("inbucket", "in/demo/right.csv")
+	e.fake.DeleteObject("inbucket", "in/demo/right.csv")
+
+	// right.csv is not there yet: the left.csv event is ACKed without work.
+	leftEvent := `{"bucket":"inbucket","name":"in/demo/left.csv"}`
+	if rec := e.post(contract.TypeFinalized, leftEvent); rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if got := e.fake.Names("outbucket", ""); len(got) != 0 {
+		t.Fatalf("ran before both inputs existed: %v", got)
+	}
+
+	// right.csv arrives last; its event and a late left.csv redelivery race.
+	e.fake.PutObject("inbucket", "in/demo/right.csv", right)
+	e.fake.AddFault(gcsfake.Fault{Object: "in/demo/left.csv", Delay: 50 * time.Millisecond, Times: 2})
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i, ev := range []string{leftEvent, finalizeEvent("demo")} {
+		wg.Add(1)
+		go func(i int, ev string) {
+			defer wg.Done()
+			codes[i] = e.post(contract.TypeFinalized, ev).Code
+		}(i, ev)
+	}
+	wg.Wait()
+
+	n := 0
+	for _, l := range e.fake.Log() {
+		if l == "upload outbucket/out/demo/_SUCCESS.json" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("marker uploaded %d times; codes=%v", n, codes)
+	}
+	for _, c := range codes {
+		if c != http.StatusNoContent && c != http.StatusTooManyRequests {
+			t.Fatalf("codes=%v", codes)
+		}
+	}
+}
+
+func TestE2E_NamedInputs(t *testing.T) {
+	fixture := func(dir, name string) []byte {
+		b, err := os.ReadFile(filepath.Join("..", "..", "fixtures", dir, name))
+		if err != nil {
+			t.Fatalf("read fixture: %v", err)
+		}
+		return b
+	}
+	cases := []struct {
+		mode      string
+		processor []byte
+		want      []string
+		plan      string
+	}{
+		{"hub", fixture("demo", "left.csv"), []string{
+			"out/nway/_SUCCESS.json",
+			"out/nway/pack/manifest.txt",
+			"out/nway/tree/inputs/bank.csv",
+			"out/nway/tree/inputs/ledger.csv",
+			"out/nway/tree/inputs/processor.csv",
+			"out/nway/tree/recon.json",
+			"out/nway/tree/sources.json",
+			"out/nway/tree/work/ledger/bank/summary.json",
+			"out/nway/tree/work/ledger/processor/summary.json",
+		}, `{
+  "mode": "hub",
+  "hub": "ledger",
+  "inputs": [
+    "bank",
+    "ledger",
+    "processor"
+  ],
+  "pairs": [
+    {
+      "left": "ledger",
+      "right": "bank",
+      "work": "work/ledger/bank",
+      "status": "ok"
+    },
+    {
+      "left": "ledger",
+      "right": "processor",
+      "work": "work/ledger/processor",
+      "status": "ok"
+    }
+  ]
+}
+`},
+		// processor has a different header: its pairs fail, the rest still run.
+		{"pairwise", fixture("bad", "left.csv"), []string{
+			"out/nway/_ERROR.json",
+			"out/nway/pack/manifest.txt",
+			"out/nway/tree/error.txt",
+			"out/nway/tree/inputs/bank.csv",
+			"out/nway/tree/inputs/ledger.csv",
+			"out/nway/tree/inputs/processor.csv",
+			"out/nway/tree/recon.json",
+			"out/nway/tree/sources.json",
+			"out/nway/tree/work/bank/ledger/summary.json",
+		}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.mode, func(t *testing.T) {
+			e := newE2E(t)
+			hub := ""
+			if tc.mode == "hub" {
+				hub = "ledger"
+			}
+			if err := e.cfg.setInputs([]string{"bank", "ledger", "processor"}, tc.mode, hub); err != nil {
+				t.Fatal(err)
+			}
+			e.handler = newHandler(e.cfg)
+			e.fake.PutObject("inbucket", "in/nway/bank.csv", fixture("demo", "left.csv"))
+			e.fake.PutObject("inbucket", "in/nway/ledger.csv", fixture("demo", "right.csv"))
+			e.fake.PutObject("inbucket", "in/nway/processor.csv", tc.processor)
+
+			// Only the last input triggers the run.
+			ev := `{"bucket":"inbucket","name":"in/nway/processor.csv"}`
+			if rec := e.post(contract.TypeFinalized, ev); rec.Code != http.StatusNoContent {
+				t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+			}
+			if got := e.fake.Names("outbucket", "out/nway/"); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("objects\n got=%v\nwant=%v", got, tc.want)
+			}
+			plan, _ := e.fake.Object("outbucket", "out/nway/tree/recon.json")
+			if tc.plan != "" && string(plan) != tc.plan {
+				t.Fatalf("recon.json=%s", plan)
+			}
+			if tc.mode == "pairwise" {
+				errTxt, _ := e.fake.Object("outbucket", "out/nway/tree/error.txt")
+				if !strings.HasPrefix(string(errTxt), "== bank vs processor ==\nrecon: header mismatch") ||
+					!strings.Contains(string(errTxt), "== ledger vs processor ==") {
+					t.Fatalf("error.txt=%s", errTxt)
+				}
+				if !strings.Contains(string(plan), `"right": "ledger",
+      "work": "work/bank/ledger",
+      "status": "ok"`) {
+					t.Fatalf("recon.json=%s", plan)
+				}
+			}
+		})
+	}
+}
+
+func TestE2E_S3NotificationFixtures(t *testing.T) {
+	cases := []struct {
+		fixture string
+		outputs bool
+	}{
+		{"minio_object_created.json", true},
+		{"aws_object_removed.json", false},
+		{"aws_other_bucket.json", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.fixture, func(t *testing.T) {
+			e := newE2E(t)
+			e.putFixture(t, "demo", "demo")
+			body, err := os.ReadFile(filepath.Join("..", "..", "fixtures", "events", "s3", tc.fixture))
+			if err != nil {
+				t.Fatalf("read fixture: %v", err)
+			}
+
+			if rec := e.postContent("application/json", string(body)); rec.Code != http.StatusNoContent {
+				t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+			}
+			_, ran := e.fake.Object("outbucket", "out/demo/_SUCCESS.json")
+			if ran != tc.outputs {
+				t.Fatalf("ran=%v want %v (objects=%v)", ran, tc.outputs, e.fake.Names("outbucket", ""))
+			}
+			if !tc.outputs && len(e.fake.Log()) != 0 {
+				t.Fatalf("storage touched: %v", e.fake.Log())
+			}
+			// Replay: the marker check ACKs a redelivery.
+			if rec := e.postContent("application/json", string(body)); rec.Code != http.StatusNoContent {
+				t.Fatalf("replay status=%d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestE2E_PubSubPushFixtures(t *testing.T) {
+	cases := []struct {
+		fixture string
+		outputs bool
+	}{
+		{"object_finalize.json", true},
+		{"object_delete.json", false},
+		{"malformed_missing_attributes.json", false},
+		{"malformed_bad_data.json", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.fixture, func(t *testing.T) {
+			e := newE2E(t)
+			e.putFixture(t, "demo", "demo")
+			body, err := os.ReadFile(filepath.Join("..", "..", "fixtures", "events", "pubsub", tc.fixture))
+			if err != nil {
+				t.Fatalf("read fixture: %v", err)
+			}
+
+			// Pub/Sub push carries no Ce-Type header.
+			if rec := e.post("", string(body)); rec.Code != http.StatusNoContent {
+				t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+			}
+			_, ran := e.fake.Object("outbucket", "out/demo/_SUCCESS.json")
+			if ran != tc.outputs {
+				t.Fatalf("ran=%v want %v (objects=%v)", ran, tc.outputs, e.fake.Names("outbucket", ""))
+			}
+			if !tc.outputs && len(e.fake.Log()) != 0 {
+				t.Fatalf("storage touched: %v", e.fake.Log())
+			}
+			if tc.outputs {
+				// objectGeneration pins right.csv like an Eventarc generation.
+				sources, _ := e.fake.Object("outbucket", "out/demo/tree/sources.json")
+				if !strings.Contains(string(sources), `"generation": "2"`) {
+					t.Fatalf("sources.json=%s", sources)
+				}
+			}
+		})
+	}
+}
+
+func (e *e2eEnv) postContent(contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func structuredEventJSON(id, ceType, runID string) string {
+	return `{"specversion":"1.0","id":"` + id + `","type":"` + ceType + `",` +
+		`"source":"//storage.googleapis.com/projects/_/buckets/inbucket",` +
+		`"datacontenttype":"application/json","data":` + finalizeEvent(runID) + `}`
+}
+
+func TestE2E_StructuredCloudEvent(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+
+	rec := e.postContent("application/cloudevents+json; charset=utf-8", structuredEventJSON("e1", contract.TypeFinalized, "demo"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if _, ok := e.fake.Object("outbucket", "out/demo/_SUCCESS.json"); !ok {
+		t.Fatalf("run did not complete")
+	}
+
+	// A structured event without type/source is ACKed and ignored.
+	if rec := e.postContent("application/cloudevents+json", `{"id":"x","data":{}}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("malformed status=%d", rec.Code)
+	}
+}
+
+func TestE2E_BatchCloudEventsReportPerEvent(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	e.putFixture(t, "baddemo", "bad")
+	e.putFixture(t, "flaky", "demo")
+	t.Setenv("GCS_RETRIES", "1")
+	e.fake.AddFault(gcsfake.Fault{Object: "in/flaky/left.csv", Status: http.StatusServiceUnavailable, Times: 10})
+
+	batch := "[" + strings.Join([]string{
+		structuredEventJSON("e1", contract.TypeFinalized, "demo"),
+		structuredEventJSON("e2", contract.TypeDeleted, "demo"),
+		`{"id":"e3"}`,
+		structuredEventJSON("e4", contract.TypeFinalized, "flaky"),
+		structuredEventJSON("e5", contract.TypeFinalized, "baddemo"),
+	}, ",") + "]"
+
+	rec := e.postContent("application/cloudevents-batch+json", batch)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status=%d want 500 (one event needs a retry); body=%s", rec.Code, rec.Body.String())
+	}
+	var report struct {
+		Events []batchOutcome `json:"events"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report: %v\n%s", err, rec.Body.String())
+	}
+	var got []string
+	for _, ev := range report.Events {
+		got = append(got, ev.ID+":"+strconv.Itoa(ev.Status))
+	}
+	want := []string{"e1:204", "e2:204", "e3:204", "e4:500", "e5:204"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("outcomes=%v want %v\n%s", got, want, rec.Body.String())
+	}
+
+	// Events in one batch succeed or fail independently.
+	for _, o := range []string{"out/demo/_SUCCESS.json", "out/baddemo/_ERROR.json"} {
+		if _, ok := e.fake.Object("outbucket", o); !ok {
+			t.Fatalf("missing %s", o)
+		}
+	}
+	if names := e.fake.Names("outbucket", "out/flaky/"); len(names) != 0 {
+		t.Fatalf("flaky outputs=%v", names)
+	}
+}
+
+func TestE2E_BatchDeadlineReportsUnstartedEvents(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "slow", "demo")
+	e.putFixture(t, "demo", "demo")
+	old := batchTimeout
+	batchTimeout = 300 * time.Millisecond
+	t.Cleanup(func() { batchTimeout = old })
+	// The first run outlives the batch deadline; the second must not start.
+	e.fake.AddFault(gcsfake.Fault{Object: "in/slow/left.csv", Delay: time.Second, Times: 10})
+
+	batch := "[" + structuredEventJSON("e1", contract.TypeFinalized, "slow") + "," +
+		structuredEventJSON("e2", contract.TypeFinalized, "demo") + "]"
+	rec := e.postContent("application/cloudevents-batch+json", batch)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status=%d want 500; body=%s", rec.Code, rec.Body.String())
+	}
+	var report struct {
+		Events []batchOutcome `json:"events"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report: %v\n%s", err, rec.Body.String())
+	}
+	if len(report.Events) != 2 || report.Events[0].Status != 500 || report.Events[1].Status != 500 ||
+		report.Events[1].Detail != "not started: batch deadline exceeded" {
+		t.Fatalf("outcomes=%+v", report.Events)
+	}
+	if names := e.fake.Names("outbucket", "out/demo/"); len(names) != 0 {
+		t.Fatalf("unstarted event produced outputs: %v", names)
+	}
+}
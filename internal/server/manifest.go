@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
+)
+
+// Trigger modes (TRIGGER_MODE).
+const (
+	// triggerRight starts a run when in/<run_id>/right.csv is finalized.
+	triggerRight = "right"
+	// triggerBoth starts a run when left.csv or right.csv is finalized and
+	// both exist, so whichever arrives last triggers it.
+	triggerBoth = "both"
+	// triggerManifest starts a run when in/<run_id>/_READY.json (or
+	// manifest.json) is finalized; the inputs may be uploaded in any order.
+	triggerManifest = "manifest"
+)
+
+// manifestNames are the objects that trigger a run in manifest mode.
+var manifestNames = []string{"_READY.json", "manifest.json"}
+
+// runManifest lists a run's inputs with their expected sizes and digests:
+//
+//	{"inputs": [
+//	  {"name": "left.csv",  "size": 123, "sha256": "<hex>"},
+//	  {"name": "right.csv", "size": 456, "crc32c": "<base64>", "md5": "<base64>"}
+//	]}
+//
+// Digests use the same encodings as sources.json (and GCS object metadata).
+type runManifest struct {
+	Inputs []manifestInput `json:"inputs"`
+}
+
+type manifestInput struct {
+	Name   string `json:"name"`
+	Size   *int64 `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// parseManifest parses and checks a manifest against the expected input file
+// names. Errors describe what is wrong with the manifest and are recorded in
+// _ERROR.json.
+func parseManifest(b []byte, files []string) (runManifest, error) {
+	var m runManifest
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return runManifest{}, fmt.Errorf("manifest is not valid JSON: %v", err)
+	}
+
+	want := map[string]bool{}
+	for _, f := range files {
+		want[f] = true
+	}
+	seen := map[string]bool{}
+	for _, in := range m.Inputs {
+		switch {
+		case !want[in.Name]:
+			return runManifest{}, fmt.Errorf("manifest lists unsupported input %q (want %s)", in.Name, strings.Join(files, ", "))
+		case seen[in.Name]:
+			return runManifest{}, fmt.Errorf("manifest lists %s twice", in.Name)
+		case in.Size == nil || *in.Size < 0:
+			return runManifest{}, fmt.Errorf("manifest entry %s has no valid size", in.Name)
+		case in.SHA256 == "" && in.CRC32C == "" && in.MD5 == "":
+			return runManifest{}, fmt.Errorf("manifest entry %s has no sha256, crc32c or md5", in.Name)
+		}
+		seen[in.Name] = true
+	}
+	for _, name := range files {
+		if !seen[name] {
+			return runManifest{}, fmt.Errorf("manifest does not list %s", name)
+		}
+	}
+	return m, nil
+}
+
+// entry returns the manifest entry for an input name.
+func (m runManifest) entry(name string) manifestInput {
+	for _, in := range m.Inputs {
+		if in.Name == name {
+			return in
+		}
+	}
+	return manifestInput{}
+}
+
+// verify compares a downloaded input against its manifest entry. It returns
+// the mismatch (the reason to reject the run), or an error if the local copy
+// could not be read, which is retryable.
+func (want manifestInput) verify(in *input) (string, error) {
+	got, err := gcsutil.FileHashes(in.path)
+	if err != nil {
+		return "", err
+	}
+	if got.Size != *want.Size {
+		return fmt.Sprintf("%s: size %d does not match manifest size %d", in.object, got.Size, *want.Size), nil
+	}
+	for _, c := range []struct{ alg, want, got string }{
+		{"sha256", strings.ToLower(want.SHA256), got.SHA256},
+		{"crc32c", want.CRC32C, got.CRC32C},
+		{"md5", want.MD5, got.MD5},
+	} {
+		if c.want != "" && c.want != c.got {
+			return fmt.Sprintf("%s: %s %s does not match manifest %s %s", in.object, c.alg, c.got, c.alg, c.want), nil
+		}
+	}
+	return "", nil
+}
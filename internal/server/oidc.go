@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOIDCIssuers = "https://accounts.google.com,accounts.google.com"
+	defaultJWKSURL     = "https://www.googleapis.com/oauth2/v3/certs"
+
+	jwksDefaultTTL   = time.Hour
+	jwksMinRefetch   = time.Minute // unknown kid refetch rate limit
+	oidcClockSkew    = time.Minute
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// errUnauthenticated marks a request whose bearer token must be rejected (401).
+// Other verifier errors (JWKS unavailable) are internal and retryable.
+var errUnauthenticated = errors.New("unauthenticated")
+
+// oidcVerifier checks the Authorization: Bearer OIDC token on push requests
+// (Pub/Sub push, Eventarc, or a load balancer in front of the service).
+type oidcVerifier struct {
+	audience string
+	issuers  map[string]bool
+	emails   map[string]bool // empty: any verified caller
+	jwksURL  string
+	client   *http.Client
+	now      func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expires   time.Time
+	lastFetch time.Time
+}
+
+// oidcFromEnv returns a verifier when OIDC_AUDIENCE is set, else nil.
+func oidcFromEnv() *oidcVerifier {
+	aud := strings.TrimSpace(os.Getenv("OIDC_AUDIENCE"))
+	if aud == "" {
+		return nil
+	}
+	return &oidcVerifier{
+		audience: aud,
+		issuers:  splitSet(getenv("OIDC_ISSUERS", defaultOIDCIssuers)),
+		emails:   splitSet(os.Getenv("OIDC_ALLOWED_EMAILS")),
+		jwksURL:  getenv("OIDC_JWKS_URL", defaultJWKSURL),
+		client:   http.DefaultClient,
+		now:      time.Now,
+	}
+}
+
+func splitSet(csv string) map[string]bool {
+	m := map[string]bool{}
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			m[v] = true
+		}
+	}
+	return m
+}
+
+type oidcClaims struct {
+	Iss           string          `json:"iss"`
+	Aud           json.RawMessage `json:"aud"` // string or array
+	Exp           int64           `json:"exp"`
+	Iat           int64           `json:"iat"`
+	Nbf           int64           `json:"nbf"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+}
+
+// verify checks r's bearer token and returns the caller's email.
+func (v *oidcVerifier) verify(ctx context.Context, r *http.Request) (string, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || raw == "" {
+		return "", fmt.Errorf("%w: missing bearer token", errUnauthenticated)
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: malformed token", errUnauthenticated)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims oidcClaims
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("%w: unsupported alg %q", errUnauthenticated, header.Alg)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed signature", errUnauthenticated)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return "", fmt.Errorf("%w: bad signature", errUnauthenticated)
+	}
+
+	now := v.now()
+	switch {
+	case !v.issuers[claims.Iss]:
+		return "", fmt.Errorf("%w: issuer %q not accepted", errUnauthenticated, claims.Iss)
+	case !audienceHas(claims.Aud, v.audience):
+		return "", fmt.Errorf("%w: audience mismatch", errUnauthenticated)
+	case claims.Exp == 0 || now.After(time.Unix(claims.Exp, 0).Add(oidcClockSkew)):
+		return "", fmt.Errorf("%w: token expired", errUnauthenticated)
+	case claims.Nbf != 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.Nbf, 0)):
+		return "", fmt.Errorf("%w: token not yet valid", errUnauthenticated)
+	case claims.Iat != 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.Iat, 0)):
+		return "", fmt.Errorf("%w: token issued in the future", errUnauthenticated)
+	}
+	if len(v.emails) > 0 && (!claims.EmailVerified || !v.emails[claims.Email]) {
+		return "", fmt.Errorf("%w: caller %q not allowed", errUnauthenticated, claims.Email)
+	}
+	return claims.Email, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return fmt.Errorf("%w: malformed token", errUnauthenticated)
+	}
+	return nil
+}
+
+func audienceHas(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, a := range many {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key for kid from the cached JWKS. The set is
+// refetched when it expires (Cache-Control max-age) or, at most once per
+// jwksMinRefetch, when kid is unknown (key rotation).
+func (v *oidcVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	if k, ok := v.keys[kid]; ok && now.Before(v.expires) {
+		return k, nil
+	}
+	if v.keys == nil || now.After(v.expires) || now.Sub(v.lastFetch) >= jwksMinRefetch {
+		if err := v.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	k, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", errUnauthenticated, kid)
+	}
+	return k, nil
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// fetch loads the JWKS. Callers hold v.mu.
+func (v *oidcVerifier) fetch(ctx context.Context) error {
+	v.lastFetch = v.now()
+
+	cctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(cctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("jwks request: %w", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("jwks status=%d", resp.StatusCode)
+	}
+
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return fmt.Errorf("jwks parse: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	v.keys = keys
+	v.expires = v.lastFetch.Add(maxAge(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+// maxAge returns the Cache-Control max-age, or jwksDefaultTTL.
+func maxAge(cc string) time.Duration {
+	for _, d := range strings.Split(cc, ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(d), "max-age="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return jwksDefaultTTL
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	contract "github.com/nicholaskarlson/proof-first-event-contracts/contract"
+)
+
+type oidcEnv struct {
+	key     *rsa.PrivateKey
+	fetches atomic.Int32
+}
+
+func newOIDCEnv(t *testing.T, e *e2eEnv) *oidcEnv {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	o := &oidcEnv{key: key}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.fetches.Add(1)
+		enc := base64.RawURLEncoding
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+			"n": enc.EncodeToString(key.N.Bytes()),
+			"e": enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+
+	e.cfg.oidc = &oidcVerifier{
+		audience: "https://pipeline.example.run.app",
+		issuers:  splitSet(defaultOIDCIssuers),
+		emails:   splitSet("pusher@proj.iam.gserviceaccount.com"),
+		jwksURL:  srv.URL,
+		client:   &http.Client{}, // the fake GCS transport owns http.DefaultClient
+		now:      time.Now,
+	}
+	e.handler = newHandler(e.cfg)
+	return o
+}
+
+func (o *oidcEnv) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	hb, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	cb, _ := json.Marshal(claims)
+	signing := enc.EncodeToString(hb) + "." + enc.EncodeToString(cb)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, o.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signing + "." + enc.EncodeToString(sig)
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            "https://pipeline.example.run.app",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"email":          "pusher@proj.iam.gserviceaccount.com",
+		"email_verified": true,
+	}
+}
+
+func TestOIDC_RejectsBeforeTouchingStorage(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	o := newOIDCEnv(t, e)
+
+	with := func(k string, v any) map[string]any {
+		c := validClaims()
+		c[k] = v
+		return c
+	}
+	tampered := o.sign(t, "k1", validClaims())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	cases := map[string]string{
+		"missing":       "",
+		"malformed":     "Bearer not-a-jwt",
+		"bad signature": "Bearer " + tampered,
+		"unknown kid":   "Bearer " + o.sign(t, "k2", validClaims()),
+		"wrong issuer":  "Bearer " + o.sign(t, "k1", with("iss", "https://evil.example")),
+		"wrong aud":     "Bearer " + o.sign(t, "k1", with("aud", "https://other.run.app")),
+		"expired":       "Bearer " + o.sign(t, "k1", with("exp", time.Now().Add(-time.Hour).Unix())),
+		"email":         "Bearer " + o.sign(t, "k1", with("email", "intruder@proj.iam.gserviceaccount.com")),
+		"unverified":    "Bearer " + o.sign(t, "k1", with("email_verified", false)),
+	}
+	for name, authz := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(finalizeEvent("demo")))
+			req.Header.Set("Ce-Type", contract.TypeFinalized)
+			if authz != "" {
+				req.Header.Set("Authorization", authz)
+			}
+			rec := httptest.NewRecorder()
+			e.handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status=%d want 401", rec.Code)
+			}
+		})
+	}
+	if log := e.fake.Log(); len(log) != 0 {
+		t.Fatalf("storage touched: %v", log)
+	}
+	// The JWKS is cached; the unknown kid causes at most one refetch.
+	if n := o.fetches.Load(); n > 2 {
+		t.Fatalf("jwks fetched %d times", n)
+	}
+}
+
+func TestOIDC_ValidTokenRuns(t *testing.T) {
+	e := newE2E(t)
+	e.putFixture(t, "demo", "demo")
+	o := newOIDCEnv(t, e)
+
+	c := validClaims()
+	c["aud"] = []string{"other", "https://pipeline.example.run.app"}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(finalizeEvent("demo")))
+	req.Header.Set("Ce-Type", contract.TypeFinalized)
+	req.Header.Set("Authorization", "Bearer "+o.sign(t, "k1", c))
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if _, ok := e.fake.Object("outbucket", "out/demo/_SUCCESS.json"); !ok {
+		t.Fatalf("run did not complete")
+	}
+}
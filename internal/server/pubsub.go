@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	contract "github.com/nicholaskarlson/proof-first-event-contracts/contract"
+)
+
+// GCS Pub/Sub notification event types and the CloudEvents types Eventarc
+// uses for the same events.
+var pubsubEventTypes = map[string]string{
+	"OBJECT_FINALIZE":        contract.TypeFinalized,
+	"OBJECT_DELETE":          contract.TypeDeleted,
+	"OBJECT_ARCHIVE":         "google.cloud.storage.object.v1.archived",
+	"OBJECT_METADATA_UPDATE": "google.cloud.storage.object.v1.metadataUpdated",
+}
+
+type pubsubPush struct {
+	Message *struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       []byte            `json:"data"` // base64 in JSON
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// pubsubEvent translates a Pub/Sub push body carrying a GCS notification
+// ({"message":{"attributes":{...},"data":...}}) into the Ce-Type and body
+// that contract.ParseEventarcAndDecide expects, so both triggers share one
+// decision flow. ok is false when body is not a push envelope; err reports a
+// malformed envelope (ACKed like any other contract error).
+func pubsubEvent(body []byte) (ceType string, event []byte, ok bool, err error) {
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(body, &probe) != nil {
+		return "", nil, false, nil
+	}
+	if _, has := probe["message"]; !has {
+		return "", nil, false, nil
+	}
+
+	var push pubsubPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return "", nil, true, errors.New("pubsub: malformed message")
+	}
+	if push.Message == nil {
+		return "", nil, true, errors.New("pubsub: empty message")
+	}
+	a := push.Message.Attributes
+	if a["eventType"] == "" || a["bucketId"] == "" || a["objectId"] == "" {
+		return "", nil, true, errors.New("pubsub: missing eventType/bucketId/objectId attributes")
+	}
+
+	ceType = pubsubEventTypes[a["eventType"]]
+	if ceType == "" {
+		ceType = "pubsub:" + a["eventType"] // unknown types fall through as ignores
+	}
+	event, err = json.Marshal(struct {
+		Bucket     string `json:"bucket"`
+		Name       string `json:"name"`
+		Generation string `json:"generation,omitempty"`
+	}{a["bucketId"], a["objectId"], a["objectGeneration"]})
+	return ceType, event, true, err
+}
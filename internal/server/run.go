@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/pipeline"
+)
+
+// runRequest is a run the trigger rules decided to start.
+type runRequest struct {
+	runID string
+	// trigger is the file name of the object whose event started the run:
+	// an input ("right.csv") or, in manifest mode, the manifest ("_READY.json").
+	trigger string
+	// generation is the trigger object's generation from the event ("" if unknown).
+	generation string
+}
+
+// input is one downloaded input file.
+type input struct {
+	name       string // stable name, e.g. "left.csv"
+	object     string // object in INPUT_BUCKET
+	generation string // pinned generation ("" when the store has none)
+	path       string // local download path
+}
+
+// processRun performs a run and returns the HTTP status for the event.
+// A non-nil error carries the status to report (5xx for retryable failures).
+func processRun(ctx context.Context, cfg config, rr runRequest) (int, error) {
+	runID := rr.runID
+
+	// Temp workspace
+	tmp, err := os.MkdirTemp("", "finance-pipeline-*")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer os.RemoveAll(tmp)
+
+	inStore, err := gcsutil.OpenStoreAs(ctx, cfg.inBucket, cfg.inIdentity)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	outStore, err := gcsutil.OpenStoreAs(ctx, cfg.outBucket, cfg.outIdentity)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Idempotency: if this run has already completed (success or error marker exists),
+	// ACK the event and return without re-running work.
+	markerPrefix := cfg.outPrefix + runID
+	if done, err := runCompleted(ctx, outStore, markerPrefix); err != nil {
+		return http.StatusInternalServerError, err
+	} else if done {
+		return http.StatusNoContent, nil
+	}
+
+	// Order-independent trigger: the event for whichever input arrives last
+	// starts the run; earlier events are ACKed.
+	if cfg.triggerMode == triggerBoth {
+		for _, name := range cfg.inputFiles() {
+			ok, err := inStore.Exists(ctx, cfg.inPrefix+runID+"/"+name)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if !ok {
+				fmt.Fprintf(os.Stdout, "run_waiting: run_id=%s %s not present yet\n", runID, name)
+				return http.StatusNoContent, nil
+			}
+		}
+	}
+
+	// Claim the run so concurrent deliveries do not both run it. Losers get 429
+	// and are retried later, by which time the marker exists.
+	if cs, ok := outStore.(gcsutil.Conditional); ok {
+		claim, err := acquireClaim(ctx, cs, markerPrefix+"/"+claimName, runID, tmp, cfg.runLease)
+		if errors.Is(err, errRunInProgress) {
+			fmt.Fprintf(os.Stdout, "run_in_progress: run_id=%s\n", runID)
+			return http.StatusTooManyRequests, err
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		defer claim.release(ctx)
+
+		// The previous holder may have finished between our check and our claim.
+		if done, err := runCompleted(ctx, outStore, markerPrefix); err != nil {
+			return http.StatusInternalServerError, err
+		} else if done {
+			return http.StatusNoContent, nil
+		}
+	}
+
+	var inputs []*input
+	var trigger *input // the input whose event started the run, if any
+	for _, name := range cfg.inputFiles() {
+		in := &input{name: name, object: cfg.inPrefix + runID + "/" + name, path: filepathOS(tmp, name)}
+		if name == rr.trigger {
+			in.generation = rr.generation
+			trigger = in
+		}
+		inputs = append(inputs, in)
+	}
+
+	// Manifest mode: the manifest lists the inputs with expected sizes and
+	// digests; a bad manifest or missing input fails the run, not the delivery.
+	var manifest runManifest
+	manifestObject := ""
+	if cfg.triggerMode == triggerManifest {
+		manifestObject = cfg.inPrefix + runID + "/" + rr.trigger
+		mpath := filepathOS(tmp, "manifest.json")
+		err := getGeneration(ctx, inStore, manifestObject, rr.generation, mpath)
+		if rr.generation != "" && errors.Is(err, gcsutil.ErrNotFound) {
+			fmt.Fprintf(os.Stdout, "event_stale: run_id=%s %s generation %s superseded\n", runID, rr.trigger, rr.generation)
+			return http.StatusNoContent, nil
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		b, err := os.ReadFile(mpath)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if manifest, err = parseManifest(b, cfg.inputFiles()); err != nil {
+			return rejectRun(ctx, cfg, outStore, tmp, runID, manifestObject+": "+err.Error(), nil)
+		}
+		for _, in := range inputs {
+			ok, err := inStore.Exists(ctx, in.object)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if !ok {
+				reason := fmt.Sprintf("%s lists %s but %s does not exist", manifestObject, in.name, in.object)
+				return rejectRun(ctx, cfg, outStore, tmp, runID, reason, nil)
+			}
+		}
+	}
+
+	// Download inputs from INPUT_BUCKET (not from the event payload).
+	if vs, ok := inStore.(gcsutil.Versioned); ok {
+		// Pin every input to one generation so an overwrite between the event
+		// and the download cannot mix versions.
+		for _, in := range inputs {
+			if in.generation != "" {
+				continue
+			}
+			attrs, err := vs.Stat(ctx, in.object)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			in.generation = attrs.Generation
+		}
+
+		// In right.csv mode the trigger input is uploaded last; an input that
+		// is newer changed after the run was signalled.
+		rightLast := cfg.triggerMode == "" || cfg.triggerMode == triggerRight
+		if cfg.rejectLeftAfterRight && rightLast && trigger != nil {
+			for _, in := range inputs {
+				if in != trigger && generationAfter(in.generation, trigger.generation) {
+					reason := fmt.Sprintf("%s generation %s is newer than %s generation %s (%s changed after %s was finalized)",
+						in.name, in.generation, trigger.name, trigger.generation,
+						strings.TrimSuffix(in.name, ".csv"), strings.TrimSuffix(trigger.name, ".csv"))
+					return rejectRun(ctx, cfg, outStore, tmp, runID, reason, generations(inputs))
+				}
+			}
+		}
+
+		for _, in := range inputs {
+			err := vs.GetGeneration(ctx, in.object, in.generation, in.path)
+			if in == trigger && rr.generation != "" && errors.Is(err, gcsutil.ErrNotFound) {
+				// The trigger input was overwritten; the newer generation has its own event.
+				fmt.Fprintf(os.Stdout, "event_stale: run_id=%s %s generation %s superseded\n", runID, in.name, in.generation)
+				return http.StatusNoContent, nil
+			}
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+	} else {
+		for _, in := range inputs {
+			if err := inStore.Get(ctx, in.object, in.path); err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+	}
+
+	if manifestObject != "" {
+		for _, in := range inputs {
+			mismatch, err := manifest.entry(in.name).verify(in)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if mismatch != "" {
+				return rejectRun(ctx, cfg, outStore, tmp, runID, mismatch, generations(inputs))
+			}
+		}
+	}
+
+	// Record what was downloaded (GCS downloads are verified against x-goog-hash).
+	sources, err := inputSources(inputs)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Run pipeline into temp output
+	outBase := filepathOS(tmp, "out")
+	var pipelineInputs []pipeline.Input
+	for _, in := range inputs {
+		pipelineInputs = append(pipelineInputs, pipeline.Input{Name: strings.TrimSuffix(in.name, ".csv"), Path: in.path})
+	}
+	res, runErr := pipeline.Run(ctx, pipeline.Config{
+		Inputs:       pipelineInputs,
+		Mode:         cfg.reconMode,
+		Hub:          cfg.reconHub,
+		OutBase:      outBase,
+		RunID:        runID,
+		Engine:       cfg.reconEngine,
+		SpecPath:     cfg.reconSpec,
+		ReconBin:     cfg.reconBin,
+		AuditpackBin: cfg.auditpackBin,
+		Sources:      sources,
+	})
+
+	// Write a completion marker into the run directory so downstream consumers
+	// can avoid reading partial outputs.
+	if err := writeCompletionMarker(res.RunDir, runID, runErr, generations(inputs)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Always upload results (pack exists even on recon failure)
+	if err := gcsutil.PutDir(ctx, outStore, markerPrefix, res.RunDir); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// IMPORTANT: for "bad data" we ACK 2xx to prevent retries.
+	if runErr != nil {
+		fmt.Fprintf(os.Stdout, "processed run_id=%s with error: %v\n", runID, runErr)
+		return http.StatusNoContent, nil
+	}
+
+	fmt.Fprintf(os.Stdout, "processed run_id=%s ok\n", runID)
+	return http.StatusNoContent, nil
+}
+
+// getGeneration downloads object at generation when the store is versioned
+// and a generation is known, and the live object otherwise.
+func getGeneration(ctx context.Context, store gcsutil.ObjectStore, object, generation, dst string) error {
+	if vs, ok := store.(gcsutil.Versioned); ok && generation != "" {
+		return vs.GetGeneration(ctx, object, generation, dst)
+	}
+	return store.Get(ctx, object, dst)
+}
+
+// runCompleted reports whether a completion marker exists under markerPrefix.
+func runCompleted(ctx context.Context, outStore gcsutil.ObjectStore, markerPrefix string) (bool, error) {
+	for _, m := range []string{"_SUCCESS.json", "_ERROR.json"} {
+		ok, err := outStore.Exists(ctx, markerPrefix+"/"+m)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// rejectRun records a run that must not proceed as an _ERROR.json-only
+// output and ACKs the event (the inputs, not the service, are at fault).
+func rejectRun(ctx context.Context, cfg config, outStore gcsutil.ObjectStore, tmp, runID, reason string, gens map[string]string) (int, error) {
+	runDir := filepathOS(filepathOS(tmp, "rejected"), runID)
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := writeCompletionMarker(runDir, runID, errors.New(reason), gens); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := gcsutil.PutDir(ctx, outStore, cfg.outPrefix+runID, runDir); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	fmt.Fprintf(os.Stdout, "rejected run_id=%s: %s\n", runID, reason)
+	return http.StatusNoContent, nil
+}
+
+// generations maps input names to pinned generations (nil if none are known).
+func generations(inputs []*input) map[string]string {
+	var m map[string]string
+	for _, in := range inputs {
+		if in.generation == "" {
+			continue
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[in.name] = in.generation
+	}
+	return m
+}
+
+// generationAfter reports whether generation a is numerically greater than b.
+// GCS generations increase with each write; unparseable values compare false.
+func generationAfter(a, b string) bool {
+	x, ok1 := new(big.Int).SetString(a, 10)
+	y, ok2 := new(big.Int).SetString(b, 10)
+	return ok1 && ok2 && x.Cmp(y) > 0
+}
+
+// eventGeneration extracts the object generation from an event body
+// (direct or {"data": {...}} envelope). Generations may be strings or numbers.
+func eventGeneration(body []byte) string {
+	var ev struct {
+		Generation json.Number `json:"generation"`
+		Data       struct {
+			Generation json.Number `json:"generation"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return ""
+	}
+	if ev.Generation != "" {
+		return ev.Generation.String()
+	}
+	return ev.Data.Generation.String()
+}
+
+// inputSources hashes the downloaded inputs, ordered by input name.
+func inputSources(inputs []*input) ([]pipeline.Source, error) {
+	sorted := append([]*input(nil), inputs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	out := make([]pipeline.Source, 0, len(sorted))
+	for _, in := range sorted {
+		h, err := gcsutil.FileHashes(in.path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pipeline.Source{
+			Name:       in.name,
+			Object:     in.object,
+			Generation: in.generation,
+			Size:       h.Size,
+			CRC32C:     h.CRC32C,
+			MD5:        h.MD5,
+			SHA256:     h.SHA256,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
+)
+
+// s3Record is one record of an S3 event notification, as delivered by AWS
+// (eventName "ObjectCreated:Put") or a MinIO webhook ("s3:ObjectCreated:Put").
+type s3Record struct {
+	EventSource string `json:"eventSource"`
+	EventName   string `json:"eventName"`
+	S3          struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"` // URL-encoded, '+' for spaces
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// s3Records returns the records of an S3 notification body. ok is false when
+// body is not one (no Records carrying s3 entries).
+func s3Records(body []byte) ([]s3Record, bool) {
+	var n struct {
+		Records []s3Record `json:"Records"`
+	}
+	if json.Unmarshal(body, &n) != nil || len(n.Records) == 0 {
+		return nil, false
+	}
+	for _, r := range n.Records {
+		if !strings.HasSuffix(r.EventSource, ":s3") {
+			return nil, false
+		}
+	}
+	return n.Records, true
+}
+
+// handleS3Records runs the trigger rule for each record. Non-create events,
+// other buckets and undecodable keys are ignored deterministically. With
+// several records the worst status wins (500, then 429), so a retry covers
+// every record that needs one; completed runs are ACKed by the marker check.
+func handleS3Records(ctx context.Context, cfg config, recs []s3Record) (int, string) {
+	status, details := http.StatusNoContent, make([]string, 0, len(recs))
+	for _, r := range recs {
+		st, detail := handleS3Record(ctx, cfg, r)
+		status = worseStatus(status, st)
+		details = append(details, detail)
+	}
+	return status, strings.Join(details, "; ")
+}
+
+func handleS3Record(ctx context.Context, cfg config, r s3Record) (int, string) {
+	event := strings.TrimPrefix(r.EventName, "s3:")
+	if !strings.HasPrefix(event, "ObjectCreated:") {
+		return s3Ignore("event " + r.EventName)
+	}
+	if want := gcsutil.BucketName(cfg.inBucket); r.S3.Bucket.Name != want {
+		return s3Ignore(fmt.Sprintf("bucket %q (want %q)", r.S3.Bucket.Name, want))
+	}
+	key, err := url.QueryUnescape(r.S3.Object.Key)
+	if err != nil {
+		return s3Ignore(fmt.Sprintf("undecodable key %q", r.S3.Object.Key))
+	}
+	return triggerRun(ctx, cfg, key, "")
+}
+
+func s3Ignore(reason string) (int, string) {
+	reason = "ignore: s3 " + reason
+	fmt.Fprintf(os.Stdout, "event_contract_ignore: %s\n", reason)
+	return http.StatusNoContent, reason
+}
+
+// worseStatus orders delivery outcomes: 5xx (retry) over 429 (retry later)
+// over anything else.
+func worseStatus(a, b int) int {
+	rank := func(s int) int {
+		switch {
+		case s >= 500:
+			return 2
+		case s == http.StatusTooManyRequests:
+			return 1
+		}
+		return 0
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
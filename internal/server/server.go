@@ -8,40 +8,175 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
 	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/pipeline"
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/recon"
 	contract "github.com/nicholaskarlson/proof-first-event-contracts/contract"
 )
 
 const maxEventBodyBytes int64 = 1 << 20 // 1MiB
 
-func Run() error {
-	inPrefix := ensureSlash(getenv("INPUT_PREFIX", "in/"))
-	outPrefix := ensureSlash(getenv("OUTPUT_PREFIX", "out/"))
+const (
+	runTimeout      = 6 * time.Minute
+	defaultRunLease = 10 * time.Minute // > runTimeout, so a live run is never taken over
+)
+
+type config struct {
+	inPrefix  string
+	outPrefix string
+
+	// inBucket / outBucket are bucket specs understood by gcsutil.OpenStore
+	// (a GCS bucket name, gs://<bucket>, or file:///<dir>).
+	inBucket  string
+	outBucket string
+
+	// inIdentity / outIdentity are service accounts to impersonate for each
+	// bucket ("" uses the runtime identity).
+	inIdentity  string
+	outIdentity string
+
+	reconBin     string
+	auditpackBin string
+	// reconEngine is pipeline.EngineExternal ("" too) or pipeline.EngineNative.
+	reconEngine string
+	// reconSpec is the path of a recon spec file ("" for none).
+	reconSpec string
+
+	// inputs are the input names, read from in/<run_id>/<name>.csv (nil:
+	// left, right). reconMode / reconHub select the recon pairs for more
+	// than two inputs (see pipeline.Config).
+	inputs    []string
+	reconMode string
+	reconHub  string
 
-	inBucket := strings.TrimSpace(os.Getenv("INPUT_BUCKET"))
-	if inBucket == "" {
-		return fmt.Errorf("INPUT_BUCKET is required")
+	// rejectLeftAfterRight fails a run whose left.csv generation is newer
+	// than the right.csv generation that triggered it.
+	rejectLeftAfterRight bool
+
+	// triggerMode selects the trigger object: triggerRight ("" too),
+	// triggerBoth or triggerManifest.
+	triggerMode string
+
+	// runLease is how long a run claim (_RUNNING.json) is honoured before
+	// another delivery may take it over. It must exceed the run timeout.
+	runLease time.Duration
+
+	// oidc verifies push requests' bearer tokens (nil: no verification).
+	oidc *oidcVerifier
+}
+
+func loadConfig() (config, error) {
+	cfg := config{
+		inPrefix:     ensureSlash(getenv("INPUT_PREFIX", "in/")),
+		outPrefix:    ensureSlash(getenv("OUTPUT_PREFIX", "out/")),
+		inBucket:     strings.TrimSpace(os.Getenv("INPUT_BUCKET")),
+		outBucket:    strings.TrimSpace(os.Getenv("OUTPUT_BUCKET")),
+		reconBin:     "recon",
+		auditpackBin: "auditpack",
+		runLease:     defaultRunLease,
+		oidc:         oidcFromEnv(),
+	}
+	both := strings.TrimSpace(os.Getenv("IMPERSONATE_SERVICE_ACCOUNT"))
+	cfg.inIdentity = getenv("INPUT_IMPERSONATE_SERVICE_ACCOUNT", both)
+	cfg.outIdentity = getenv("OUTPUT_IMPERSONATE_SERVICE_ACCOUNT", both)
+	// A retry cannot fix this, so fail at startup rather than 500 per event.
+	if err := gcsutil.CheckImpersonation(cfg.inBucket, cfg.inIdentity); err != nil {
+		return config{}, fmt.Errorf("INPUT_BUCKET: %w", err)
+	}
+	if err := gcsutil.CheckImpersonation(cfg.outBucket, cfg.outIdentity); err != nil {
+		return config{}, fmt.Errorf("OUTPUT_BUCKET: %w", err)
+	}
+	if v := strings.TrimSpace(os.Getenv("RUN_LEASE")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return config{}, fmt.Errorf("RUN_LEASE: invalid duration %q", v)
+		}
+		if d <= runTimeout {
+			return config{}, fmt.Errorf("RUN_LEASE: %s must exceed the %s run timeout", d, runTimeout)
+		}
+		cfg.runLease = d
+	}
+	switch cfg.reconEngine = strings.TrimSpace(os.Getenv("RECON_ENGINE")); cfg.reconEngine {
+	case "", pipeline.EngineExternal, pipeline.EngineNative:
+	default:
+		return config{}, fmt.Errorf("RECON_ENGINE: want %q or %q, got %q", pipeline.EngineExternal, pipeline.EngineNative, cfg.reconEngine)
+	}
+	if cfg.reconSpec = strings.TrimSpace(os.Getenv("RECON_SPEC")); cfg.reconSpec != "" {
+		if err := checkSpec(cfg.reconEngine, cfg.reconSpec); err != nil {
+			return config{}, fmt.Errorf("RECON_SPEC: %w", err)
+		}
+	}
+	var inputs []string
+	if v := strings.TrimSpace(os.Getenv("INPUTS")); v != "" {
+		inputs = strings.Split(v, ",")
+	}
+	if err := cfg.setInputs(inputs, os.Getenv("RECON_MODE"), os.Getenv("RECON_HUB")); err != nil {
+		return config{}, err
+	}
+	switch cfg.triggerMode = strings.TrimSpace(getenv("TRIGGER_MODE", triggerRight)); cfg.triggerMode {
+	case triggerRight, triggerBoth, triggerManifest:
+	default:
+		return config{}, fmt.Errorf("TRIGGER_MODE: want %q, %q or %q, got %q", triggerRight, triggerBoth, triggerManifest, cfg.triggerMode)
+	}
+	if v := strings.TrimSpace(os.Getenv("REJECT_LEFT_AFTER_RIGHT")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return config{}, fmt.Errorf("REJECT_LEFT_AFTER_RIGHT: %w", err)
+		}
+		cfg.rejectLeftAfterRight = b
+	}
+	if cfg.inBucket == "" {
+		return config{}, fmt.Errorf("INPUT_BUCKET is required")
+	}
+	if cfg.outBucket == "" {
+		return config{}, fmt.Errorf("OUTPUT_BUCKET is required")
 	}
+	return cfg, nil
+}
 
-	outBucket := strings.TrimSpace(os.Getenv("OUTPUT_BUCKET"))
-	if outBucket == "" {
-		return fmt.Errorf("OUTPUT_BUCKET is required")
+func Run() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
 	}
 
 	port := getenv("PORT", "8080")
 	addr := ":" + port
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/", newHandler(cfg))
+
+	fmt.Printf("listening on %s\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func newHandler(cfg config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
+		// Authenticate before reading the body or touching storage.
+		if cfg.oidc != nil {
+			if _, err := cfg.oidc.verify(r.Context(), r); err != nil {
+				if errors.Is(err, errUnauthenticated) {
+					fmt.Fprintf(os.Stdout, "auth_rejected: %v\n", err)
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					http.Error(w, "unauthenticated", http.StatusUnauthorized)
+					return
+				}
+				// JWKS unavailable: let the sender retry.
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
 		r.Body = http.MaxBytesReader(w, r.Body, maxEventBodyBytes)
 		body, err := io.ReadAll(r.Body)
 		_ = r.Body.Close()
@@ -55,122 +190,108 @@ func Run() error {
 			return
 		}
 
-		dec, obj, errText := contract.ParseEventarcAndDecide(r.Header.Get("Ce-Type"), body, inBucket)
-		if errText != nil {
-			// Malformed / unexpected events should not cause retries.
-			fmt.Fprintf(os.Stdout, "event_contract_error: %s", *errText)
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		if !dec.ShouldRun {
-			// Deterministic ignores (delete/archive/metadata updates, wrong bucket, etc.).
-			fmt.Fprintf(os.Stdout, "event_contract_ignore: %s\n", dec.Reason)
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		name := obj.NameUnescaped
-		if name == "" {
-			name = obj.Name
-		}
-
-		// Trigger only on: in/<runID>/right.csv
-		runID, ok := parseRunID(name, inPrefix)
-		if !ok {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		// Temp workspace
-		tmp, err := os.MkdirTemp("", "finance-pipeline-*")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		ceType := r.Header.Get("Ce-Type")
+		switch mediaType(r.Header.Get("Content-Type")) {
+		case batchContentType:
+			serveBatch(w, r.Context(), cfg, body)
 			return
+		case structuredContentType:
+			ev, err := parseStructured(body)
+			if err != nil {
+				fmt.Fprintf(os.Stdout, "event_contract_error: %v\n", err)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			ceType, body = ev.Type, ev.payload()
+		default:
+			if ceType == "" {
+				// S3 / MinIO bucket notifications (webhook delivery).
+				if recs, ok := s3Records(body); ok {
+					status, detail := handleS3Records(r.Context(), cfg, recs)
+					if status >= 400 {
+						http.Error(w, detail, status)
+						return
+					}
+					w.WriteHeader(status)
+					return
+				}
+				// Without Ce-Type the body may be a Pub/Sub push of a GCS notification.
+				if t, ev, ok, err := pubsubEvent(body); ok {
+					if err != nil {
+						// Malformed messages are ACKed so Pub/Sub does not redeliver them forever.
+						fmt.Fprintf(os.Stdout, "event_contract_error: %v\n", err)
+						w.WriteHeader(http.StatusNoContent)
+						return
+					}
+					ceType, body = t, ev
+				}
+			}
 		}
-		defer os.RemoveAll(tmp)
-
-		leftObj := inPrefix + runID + "/left.csv"
-		rightObj := inPrefix + runID + "/right.csv"
-
-		leftPath := filepathOS(tmp, "left.csv")
-		rightPath := filepathOS(tmp, "right.csv")
 
-		ctx, cancel := context.WithTimeout(r.Context(), 6*time.Minute)
-		defer cancel()
-
-		token, err := gcsutil.AccessToken(ctx)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		status, detail := handleEvent(r.Context(), cfg, ceType, body)
+		if status >= 400 {
+			http.Error(w, detail, status)
 			return
 		}
+		w.WriteHeader(status)
+	})
+}
 
-		// Idempotency: if this run has already completed (success or error marker exists),
-		// ACK the event and return without re-running work.
-		markerPrefix := outPrefix + runID
-		if ok, err := gcsutil.ObjectExists(ctx, token, outBucket, markerPrefix+"/_SUCCESS.json"); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		} else if ok {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		if ok, err := gcsutil.ObjectExists(ctx, token, outBucket, markerPrefix+"/_ERROR.json"); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		} else if ok {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+// handleEvent applies the contract decision and trigger rule to one event
+// and runs it. It returns the HTTP status for the delivery and a short detail
+// (ignore reason or error text).
+func handleEvent(ctx context.Context, cfg config, ceType string, body []byte) (int, string) {
+	dec, obj, errText := contract.ParseEventarcAndDecide(ceType, body, gcsutil.BucketName(cfg.inBucket))
+	if errText != nil {
+		// Malformed / unexpected events should not cause retries.
+		fmt.Fprintf(os.Stdout, "event_contract_error: %s", *errText)
+		return http.StatusNoContent, strings.TrimSpace(*errText)
+	}
 
-		// Download inputs from INPUT_BUCKET (not from the event payload).
-		if err := gcsutil.DownloadToFile(ctx, token, inBucket, leftObj, leftPath); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if err := gcsutil.DownloadToFile(ctx, token, inBucket, rightObj, rightPath); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if !dec.ShouldRun {
+		// Deterministic ignores (delete/archive/metadata updates, wrong bucket, etc.).
+		fmt.Fprintf(os.Stdout, "event_contract_ignore: %s\n", dec.Reason)
+		return http.StatusNoContent, dec.Reason
+	}
 
-		// Run pipeline into temp output
-		outBase := filepathOS(tmp, "out")
-		res, runErr := pipeline.Run(ctx, pipeline.Config{
-			LeftPath:     leftPath,
-			RightPath:    rightPath,
-			OutBase:      outBase,
-			RunID:        runID,
-			ReconBin:     "recon",
-			AuditpackBin: "auditpack",
-		})
-
-		// Write a completion marker into the run directory so downstream consumers
-		// can avoid reading partial outputs.
-		if err := writeCompletionMarker(res.RunDir, runID, runErr); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	name := obj.NameUnescaped
+	if name == "" {
+		name = obj.Name
+	}
 
-		// Always upload results (pack exists even on recon failure)
-		uploadPrefix := outPrefix + runID
-		if err := gcsutil.UploadDir(ctx, token, outBucket, uploadPrefix, res.RunDir); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	return triggerRun(ctx, cfg, name, eventGeneration(body))
+}
 
-		// IMPORTANT: for "bad data" we ACK 2xx to prevent retries.
-		if runErr != nil {
-			fmt.Fprintf(os.Stdout, "processed run_id=%s with error: %v\n", runID, runErr)
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+// triggerRun applies the trigger rule to an object name from any event source
+// and runs the matching run. generation pins the trigger object ("" if unknown).
+func triggerRun(ctx context.Context, cfg config, name, generation string) (int, string) {
+	var files []string
+	switch cfg.triggerMode {
+	case triggerManifest:
+		// Trigger only on: in/<runID>/_READY.json or in/<runID>/manifest.json
+		files = manifestNames
+	case triggerBoth:
+		// Trigger on any input; processRun waits until all exist.
+		files = cfg.inputFiles()
+	default:
+		// Trigger only on: in/<runID>/right.csv (the last input)
+		all := cfg.inputFiles()
+		files = all[len(all)-1:]
+	}
+	runID, file, ok := parseRunObject(name, cfg.inPrefix, files...)
+	if !ok {
+		return http.StatusNoContent, "not a trigger object: " + name
+	}
+	rr := runRequest{runID: runID, trigger: file, generation: generation}
 
-		fmt.Fprintf(os.Stdout, "processed run_id=%s ok\n", runID)
-		w.WriteHeader(http.StatusNoContent)
-	})
+	ctx, cancel := context.WithTimeout(ctx, runTimeout)
+	defer cancel()
 
-	fmt.Printf("listening on %s\n", addr)
-	return http.ListenAndServe(addr, mux)
+	status, err := processRun(ctx, cfg, rr)
+	if err != nil {
+		return status, err.Error()
+	}
+	return status, "run_id=" + runID
 }
 
 func validRunID(runID string) bool {
@@ -200,23 +321,99 @@ func validRunID(runID string) bool {
 //
 // run_id is intentionally restrictive to prevent path traversal / prefix escape.
 func parseRunID(objectName, inputPrefix string) (string, bool) {
+	runID, _, ok := parseRunObject(objectName, inputPrefix, "right.csv")
+	return runID, ok
+}
+
+// parseRunObject is parseRunID for any of the given file names:
+//
+//	in/<run_id>/<name>
+//
+// It returns the run id and the matched name.
+func parseRunObject(objectName, inputPrefix string, names ...string) (string, string, bool) {
 	inputPrefix = ensureSlash(inputPrefix)
 	if !strings.HasPrefix(objectName, inputPrefix) {
-		return "", false
+		return "", "", false
 	}
 	rest := strings.TrimPrefix(objectName, inputPrefix)
 	parts := strings.Split(rest, "/")
 	if len(parts) != 2 {
-		return "", false
+		return "", "", false
 	}
 	runID := parts[0]
-	if parts[1] != "right.csv" {
-		return "", false
-	}
 	if !validRunID(runID) {
-		return "", false
+		return "", "", false
+	}
+	for _, name := range names {
+		if parts[1] == name {
+			return runID, name, true
+		}
+	}
+	return "", "", false
+}
+
+// setInputs validates and sets the input names (nil: left, right) and the
+// recon mode and hub.
+func (cfg *config) setInputs(names []string, mode, hub string) error {
+	cfg.inputs = nil
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !pipeline.ValidInputName(name) || seen[name] {
+			return fmt.Errorf("INPUTS: invalid or duplicate input name %q", name)
+		}
+		seen[name] = true
+		cfg.inputs = append(cfg.inputs, name)
+	}
+	if len(names) == 1 {
+		return fmt.Errorf("INPUTS: need at least two inputs")
+	}
+	switch cfg.reconMode = strings.TrimSpace(mode); cfg.reconMode {
+	case "", pipeline.ModePairwise, pipeline.ModeHub:
+	default:
+		return fmt.Errorf("RECON_MODE: want %q or %q, got %q", pipeline.ModePairwise, pipeline.ModeHub, cfg.reconMode)
+	}
+	if cfg.reconMode != "" && slices.Equal(cfg.inputNames(), []string{"left", "right"}) {
+		// Plain left/right inputs run one recon; a mode would be ignored.
+		return fmt.Errorf("RECON_MODE: needs INPUTS other than left,right (those run a single recon)")
+	}
+	cfg.reconHub = strings.TrimSpace(hub)
+	if cfg.reconHub != "" {
+		if cfg.reconMode != pipeline.ModeHub {
+			return fmt.Errorf("RECON_HUB: needs RECON_MODE=%s", pipeline.ModeHub)
+		}
+		if !slices.Contains(cfg.inputNames(), cfg.reconHub) {
+			return fmt.Errorf("RECON_HUB: %q is not one of the inputs", cfg.reconHub)
+		}
+	}
+	return nil
+}
+
+// checkSpec fails fast on a recon spec the pipeline would reject on every run.
+func checkSpec(engine, path string) error {
+	if engine != pipeline.EngineNative {
+		return fmt.Errorf("a recon spec needs the %s engine", pipeline.EngineNative)
+	}
+	_, err := recon.LoadSpec(path)
+	return err
+}
+
+// inputNames returns the configured input names (left, right by default).
+func (cfg config) inputNames() []string {
+	if len(cfg.inputs) == 0 {
+		return []string{"left", "right"}
+	}
+	return cfg.inputs
+}
+
+// inputFiles returns the input file names, e.g. "left.csv", in input order.
+// The last one is the trigger in right.csv mode.
+func (cfg config) inputFiles() []string {
+	var files []string
+	for _, name := range cfg.inputNames() {
+		files = append(files, name+".csv")
 	}
-	return runID, true
+	return files
 }
 
 func ensureSlash(p string) string {
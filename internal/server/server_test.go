@@ -1,6 +1,13 @@
 package server
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestParseRunID(t *testing.T) {
 	tests := []struct {
@@ -80,3 +87,152 @@ func TestParseRunID(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRunObject_EitherInput(t *testing.T) {
+	for _, name := range []string{"left.csv", "right.csv"} {
+		id, got, ok := parseRunObject("in/demo/"+name, "in/", "left.csv", "right.csv")
+		if !ok || id != "demo" || got != name {
+			t.Fatalf("%s: id=%q name=%q ok=%v", name, id, got, ok)
+		}
+	}
+	if _, _, ok := parseRunObject("in/demo/other.csv", "in/", "left.csv", "right.csv"); ok {
+		t.Fatal("other.csv accepted")
+	}
+	if _, _, ok := parseRunObject("in/../left.csv", "in/", "left.csv", "right.csv"); ok {
+		t.Fatal("traversal run id accepted")
+	}
+}
+
+func TestLoadConfig_Impersonation(t *testing.T) {
+	t.Setenv("INPUT_BUCKET", "in-bkt")
+	t.Setenv("OUTPUT_BUCKET", "out-bkt")
+	t.Setenv("IMPERSONATE_SERVICE_ACCOUNT", "both@p.iam.gserviceaccount.com")
+	t.Setenv("INPUT_IMPERSONATE_SERVICE_ACCOUNT", "")
+	t.Setenv("OUTPUT_IMPERSONATE_SERVICE_ACCOUNT", "client@c.iam.gserviceaccount.com")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.inIdentity != "both@p.iam.gserviceaccount.com" || cfg.outIdentity != "client@c.iam.gserviceaccount.com" {
+		t.Fatalf("inIdentity=%q outIdentity=%q", cfg.inIdentity, cfg.outIdentity)
+	}
+
+	// Impersonation needs GCS buckets: other stores are rejected at startup.
+	for _, bucket := range []string{"s3://drop", "az://drop", "file:///tmp/drop"} {
+		t.Setenv("INPUT_BUCKET", bucket)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("INPUT_BUCKET=%s with impersonation: expected error", bucket)
+		}
+	}
+	t.Setenv("INPUT_BUCKET", "in-bkt")
+	t.Setenv("OUTPUT_BUCKET", "file:///tmp/out")
+	if _, err := loadConfig(); err == nil {
+		t.Error("OUTPUT_BUCKET=file:// with impersonation: expected error")
+	}
+}
+
+func TestLoadConfig_RunLease(t *testing.T) {
+	t.Setenv("INPUT_BUCKET", "in-bkt")
+	t.Setenv("OUTPUT_BUCKET", "out-bkt")
+
+	t.Setenv("RUN_LEASE", "7m")
+	if cfg, err := loadConfig(); err != nil || cfg.runLease != 7*time.Minute {
+		t.Fatalf("runLease=%v err=%v", cfg.runLease, err)
+	}
+	// A lease within the run timeout would let a live run be taken over.
+	for _, v := range []string{"6m", "30s", "0s", "-1m", "soon"} {
+		t.Setenv("RUN_LEASE", v)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("RUN_LEASE=%s: expected error", v)
+		}
+	}
+}
+
+func TestLoadConfig_TriggerMode(t *testing.T) {
+	t.Setenv("INPUT_BUCKET", "in-bkt")
+	t.Setenv("OUTPUT_BUCKET", "out-bkt")
+
+	t.Setenv("TRIGGER_MODE", "manifest")
+	if cfg, err := loadConfig(); err != nil || cfg.triggerMode != triggerManifest {
+		t.Fatalf("triggerMode=%q err=%v", cfg.triggerMode, err)
+	}
+	t.Setenv("TRIGGER_MODE", "left")
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("expected error for unknown TRIGGER_MODE")
+	}
+}
+
+func TestLoadConfig_Inputs(t *testing.T) {
+	t.Setenv("INPUT_BUCKET", "in-bkt")
+	t.Setenv("OUTPUT_BUCKET", "out-bkt")
+
+	t.Setenv("INPUTS", "bank, ledger,processor")
+	t.Setenv("RECON_MODE", "hub")
+	t.Setenv("RECON_HUB", "ledger")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if got := cfg.inputFiles(); !reflect.DeepEqual(got, []string{"bank.csv", "ledger.csv", "processor.csv"}) {
+		t.Fatalf("inputFiles=%v", got)
+	}
+
+	for _, bad := range [][2]string{{"INPUTS", "bank"}, {"INPUTS", "bank,bank"}, {"INPUTS", "bank,../x"}, {"RECON_HUB", "other"}, {"RECON_MODE", "star"}, {"RECON_MODE", "pairwise"}, {"RECON_MODE", ""}} {
+		t.Run(bad[0]+"="+bad[1], func(t *testing.T) {
+			t.Setenv(bad[0], bad[1])
+			if _, err := loadConfig(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	// Plain left/right inputs run one recon, so a mode would be ignored.
+	t.Setenv("RECON_HUB", "")
+	for _, inputs := range []string{"", "left,right"} {
+		t.Setenv("INPUTS", inputs)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("RECON_MODE=hub with INPUTS=%q: expected error", inputs)
+		}
+	}
+}
+
+func TestLoadConfig_ReconSpec(t *testing.T) {
+	t.Setenv("INPUT_BUCKET", "in-bkt")
+	t.Setenv("OUTPUT_BUCKET", "out-bkt")
+	spec := filepath.Join(t.TempDir(), "spec.json")
+	if err := os.WriteFile(spec, []byte(`{"key":["id"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RECON_SPEC", spec)
+
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("expected error: spec without the native engine")
+	}
+	t.Setenv("RECON_ENGINE", "native")
+	if cfg, err := loadConfig(); err != nil || cfg.reconSpec != spec {
+		t.Fatalf("reconSpec=%q err=%v", cfg.reconSpec, err)
+	}
+}
+
+func TestManifestVerify_ReadErrorIsNotAMismatch(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "left.csv")
+	if err := os.WriteFile(p, []byte("id\n1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(5)
+	in := &input{name: "left.csv", object: "in/demo/left.csv", path: p}
+
+	if mismatch, err := (manifestInput{Size: &size}).verify(in); mismatch != "" || err != nil {
+		t.Fatalf("mismatch=%q err=%v", mismatch, err)
+	}
+	size = 6
+	if mismatch, err := (manifestInput{Size: &size}).verify(in); err != nil || !strings.Contains(mismatch, "size 5 does not match manifest size 6") {
+		t.Fatalf("mismatch=%q err=%v", mismatch, err)
+	}
+	// A local read failure is retryable (500), never a rejection.
+	in.path = filepath.Join(t.TempDir(), "gone.csv")
+	if mismatch, err := (manifestInput{Size: &size}).verify(in); mismatch != "" || err == nil {
+		t.Fatalf("mismatch=%q err=%v want read error", mismatch, err)
+	}
+}
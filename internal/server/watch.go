@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
+)
+
+// WatchConfig configures the local watch-folder loop (`pipeline watch`).
+type WatchConfig struct {
+	InDir     string // holds <InPrefix><run_id>/<input>.csv
+	OutDir    string // receives <OutPrefix><run_id>/... (markers last)
+	InPrefix  string // default "in/"
+	OutPrefix string // default "" (runs directly under OutDir)
+
+	Interval time.Duration // poll interval (default 2s)
+	// Settle is how long both inputs must keep the same size and mtime before
+	// a run starts, so files still being written are not read (default 5s).
+	Settle time.Duration
+	Lease  time.Duration // claim lease (default 10m, must exceed 6m); see RUN_LEASE
+
+	// Inputs names the input files (nil: left, right); the last one triggers
+	// a run. Mode and Hub are as in pipeline.Config.
+	Inputs []string
+	Mode   string
+	Hub    string
+
+	Engine       string // pipeline.EngineExternal (default) or pipeline.EngineNative
+	SpecPath     string // recon spec (needs EngineNative)
+	ReconBin     string
+	AuditpackBin string
+
+	Once bool // scan, wait Settle, run what is ready, and return
+}
+
+// Watch polls InDir for in/<run_id>/right.csv (the last input) and runs each
+// settled run once.
+// It uses the server's run path on local stores: the same trigger rule,
+// _SUCCESS.json/_ERROR.json replay checks and _RUNNING.json claims, so
+// several watchers (or a restarted one) never run the same run twice.
+func Watch(ctx context.Context, wc WatchConfig) error {
+	cfg, err := wc.config()
+	if err != nil {
+		return err
+	}
+	w := &watcher{cfg: cfg, wc: wc, seen: map[string]inputState{}, done: map[string]bool{}}
+
+	if wc.Once {
+		if _, err := w.poll(ctx, time.Now()); err != nil {
+			return err
+		}
+		if err := sleepCtx(ctx, wc.Settle); err != nil {
+			return err
+		}
+		ready, err := w.poll(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		// Runs left for retry (5xx, or claimed elsewhere) are work not done.
+		var pending []string
+		for _, runID := range ready {
+			if !w.done[runID] {
+				pending = append(pending, runID)
+			}
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("watch: %d run(s) did not complete: %s", len(pending), strings.Join(pending, ", "))
+		}
+		return nil
+	}
+
+	fmt.Fprintf(os.Stdout, "watching %s (every %s)\n", filepath.Join(wc.InDir, wc.InPrefix), wc.Interval)
+	for {
+		if _, err := w.poll(ctx, time.Now()); err != nil {
+			fmt.Fprintf(os.Stdout, "watch_error: %v\n", err)
+		}
+		if err := sleepCtx(ctx, wc.Interval); err != nil {
+			return nil // cancelled: clean shutdown
+		}
+	}
+}
+
+func (wc *WatchConfig) config() (config, error) {
+	if wc.InDir == "" || wc.OutDir == "" {
+		return config{}, fmt.Errorf("watch: input and output directories are required")
+	}
+	if wc.InPrefix == "" {
+		wc.InPrefix = "in/"
+	}
+	if wc.Interval <= 0 {
+		wc.Interval = 2 * time.Second
+	}
+	if wc.Settle < 0 {
+		wc.Settle = 0
+	}
+	if wc.Lease == 0 {
+		wc.Lease = defaultRunLease
+	}
+	if wc.Lease <= runTimeout {
+		return config{}, fmt.Errorf("lease: %s must exceed the %s run timeout", wc.Lease, runTimeout)
+	}
+	in, err := filepath.Abs(wc.InDir)
+	if err != nil {
+		return config{}, err
+	}
+	out, err := filepath.Abs(wc.OutDir)
+	if err != nil {
+		return config{}, err
+	}
+	cfg := config{
+		inPrefix:     ensureSlash(wc.InPrefix),
+		outPrefix:    ensureSlash(wc.OutPrefix),
+		inBucket:     fileSpec(in),
+		outBucket:    fileSpec(out),
+		reconEngine:  wc.Engine,
+		reconSpec:    wc.SpecPath,
+		reconBin:     wc.ReconBin,
+		auditpackBin: wc.AuditpackBin,
+		runLease:     wc.Lease,
+	}
+	if err := cfg.setInputs(wc.Inputs, wc.Mode, wc.Hub); err != nil {
+		return config{}, fmt.Errorf("watch: %w", err)
+	}
+	if wc.SpecPath != "" {
+		if err := checkSpec(wc.Engine, wc.SpecPath); err != nil {
+			return config{}, fmt.Errorf("watch: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// inputState is the observed size and mtime of a run's inputs.
+type inputState struct {
+	sig   string
+	since time.Time // when sig was first observed
+}
+
+type watcher struct {
+	cfg  config
+	wc   WatchConfig
+	seen map[string]inputState
+	done map[string]bool // ACKed runs (completed, rejected, or not runnable) still in InDir
+}
+
+// poll scans once and runs every settled run in run_id order. It returns the
+// run IDs it attempted.
+func (w *watcher) poll(ctx context.Context, now time.Time) ([]string, error) {
+	store := gcsutil.NewLocalStore(w.wc.InDir)
+	names, err := store.List(ctx, w.cfg.inPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := w.cfg.inputFiles()
+	last := files[len(files)-1]
+
+	var ready []string
+	present := map[string]bool{}
+	for _, name := range names {
+		runID, _, ok := parseRunObject(name, w.cfg.inPrefix, last)
+		if ok {
+			present[runID] = true
+		}
+		if !ok || w.done[runID] {
+			continue
+		}
+		sig, ok := w.signature(store.Root, runID)
+		if !ok {
+			continue // another input is not there yet
+		}
+		st, seen := w.seen[runID]
+		if !seen || st.sig != sig {
+			w.seen[runID] = inputState{sig: sig, since: now}
+			if w.wc.Settle > 0 {
+				continue
+			}
+			st = w.seen[runID]
+		}
+		if now.Sub(st.since) >= w.wc.Settle {
+			ready = append(ready, runID)
+		}
+	}
+	sort.Strings(ready)
+
+	// Forget runs whose inputs are gone, so a long-running watcher stays small.
+	for runID := range w.done {
+		if !present[runID] {
+			delete(w.done, runID)
+		}
+	}
+	for runID := range w.seen {
+		if !present[runID] {
+			delete(w.seen, runID)
+		}
+	}
+
+	for _, runID := range ready {
+		if err := ctx.Err(); err != nil {
+			return ready, err
+		}
+		status, detail := triggerRun(ctx, w.cfg, w.cfg.inPrefix+runID+"/"+last, "")
+		switch {
+		case status >= 500:
+			fmt.Fprintf(os.Stdout, "watch_run_error: run_id=%s status=%d: %s (will retry)\n", runID, status, detail)
+		case status == 429:
+			fmt.Fprintf(os.Stdout, "watch_run_busy: run_id=%s claimed elsewhere (will retry)\n", runID)
+		default:
+			w.done[runID] = true
+			delete(w.seen, runID)
+		}
+	}
+	return ready, nil
+}
+
+// signature describes the inputs' sizes and mtimes ("", false if any is missing).
+func (w *watcher) signature(root, runID string) (string, bool) {
+	sig := ""
+	for _, f := range w.cfg.inputFiles() {
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(w.cfg.inPrefix+runID), f))
+		if err != nil || !fi.Mode().IsRegular() {
+			return "", false
+		}
+		sig += fmt.Sprintf("%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sig, true
+}
+
+// fileSpec turns an absolute directory into a file:/// store spec.
+func fileSpec(dir string) string {
+	dir = filepath.ToSlash(dir)
+	if !strings.HasPrefix(dir, "/") {
+		dir = "/" + dir // C:/dir -> /C:/dir
+	}
+	return (&url.URL{Scheme: "file", Path: dir}).String() // escapes %, # and ?
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicholaskarlson/finance-pipeline-gcp/internal/gcsutil"
+)
+
+func newWatcher(t *testing.T, settle time.Duration) (*watcher, string, string) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+	t.Setenv("FAKE_TOOLS", "1")
+
+	in, out := t.TempDir(), t.TempDir()
+	wc := WatchConfig{InDir: in, OutDir: out, Settle: settle, ReconBin: exe, AuditpackBin: exe}
+	cfg, err := wc.config()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	return &watcher{cfg: cfg, wc: wc, seen: map[string]inputState{}, done: map[string]bool{}}, in, out
+}
+
+func copyFixture(t *testing.T, inDir, runID, fixture string, names ...string) {
+	t.Helper()
+	dir := filepath.Join(inDir, "in", runID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join("..", "..", "fixtures", fixture, name))
+		if err != nil {
+			t.Fatalf("read fixture: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatch_RunsSettledRunsInOrderOnce(t *testing.T) {
+	w, in, out := newWatcher(t, time.Minute)
+	ctx := context.Background()
+	copyFixture(t, in, "zeta", "demo", "left.csv", "right.csv")
+	copyFixture(t, in, "alpha", "bad", "left.csv", "right.csv")
+	copyFixture(t, in, "leftonly", "demo", "left.csv")
+
+	t0 := time.Now()
+	if got, err := w.poll(ctx, t0); err != nil || len(got) != 0 {
+		t.Fatalf("first sighting ran %v (err=%v); inputs have not settled", got, err)
+	}
+
+	// right.csv is still growing: that run must wait for a fresh settle period.
+	f, err := os.OpenFile(filepath.Join(in, "in", "zeta", "right.csv"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("\n")
+	_ = f.Close()
+	got, err := w.poll(ctx, t0.Add(time.Minute))
+	if err != nil || !reflect.DeepEqual(got, []string{"alpha"}) {
+		t.Fatalf("ran %v (err=%v), want [alpha]", got, err)
+	}
+
+	got, err = w.poll(ctx, t0.Add(3*time.Minute))
+	if err != nil || !reflect.DeepEqual(got, []string{"zeta"}) {
+		t.Fatalf("ran %v (err=%v), want [zeta]", got, err)
+	}
+	for _, p := range []string{"alpha/_ERROR.json", "zeta/_SUCCESS.json"} {
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(p))); err != nil {
+			t.Fatalf("missing %s: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "zeta", claimName)); !os.IsNotExist(err) {
+		t.Fatalf("claim left behind: %v", err)
+	}
+
+	// A restarted watcher sees the markers and does no work.
+	w2 := &watcher{cfg: w.cfg, wc: w.wc, seen: map[string]inputState{}, done: map[string]bool{}}
+	w2.wc.Settle = 0
+	before, _ := os.ReadFile(filepath.Join(out, "zeta", "_SUCCESS.json"))
+	if _, err := w2.poll(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.ReadFile(filepath.Join(out, "zeta", "_SUCCESS.json"))
+	if string(before) != string(after) || !w2.done["zeta"] || !w2.done["alpha"] || w2.done["leftonly"] {
+		t.Fatalf("restart: done=%v", w2.done)
+	}
+}
+
+func TestWatchConfig_Lease(t *testing.T) {
+	wc := WatchConfig{InDir: t.TempDir(), OutDir: t.TempDir()}
+	if cfg, err := wc.config(); err != nil || cfg.runLease != defaultRunLease {
+		t.Fatalf("runLease=%v err=%v", cfg.runLease, err)
+	}
+	for _, d := range []time.Duration{runTimeout, time.Minute, -time.Minute} {
+		wc.Lease = d
+		if _, err := wc.config(); err == nil {
+			t.Errorf("lease %v: expected error", d)
+		}
+	}
+}
+
+func TestFileSpec_RoundTripsSpecialCharacters(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "100% #1 ?drop")
+	s, err := gcsutil.OpenStore(context.Background(), fileSpec(dir))
+	if err != nil {
+		t.Fatalf("OpenStore(%s): %v", fileSpec(dir), err)
+	}
+	if ls, ok := s.(*gcsutil.LocalStore); !ok || ls.Root != dir {
+		t.Fatalf("store=%#v want root %q", s, dir)
+	}
+}
+
+func TestWatch_ForgetsRunsWhoseInputsAreGone(t *testing.T) {
+	w, in, _ := newWatcher(t, 0)
+	ctx := context.Background()
+	copyFixture(t, in, "demo", "demo", "left.csv", "right.csv")
+	if got, err := w.poll(ctx, time.Now()); err != nil || !reflect.DeepEqual(got, []string{"demo"}) || !w.done["demo"] {
+		t.Fatalf("ran %v (err=%v) done=%v", got, err, w.done)
+	}
+	if err := os.RemoveAll(filepath.Join(in, "in", "demo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.poll(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.done) != 0 || len(w.seen) != 0 {
+		t.Fatalf("done=%v seen=%v want empty", w.done, w.seen)
+	}
+}
+
+func TestWatch_OnceFailsWhenARunIsLeftUndone(t *testing.T) {
+	w, in, out := newWatcher(t, 0)
+	copyFixture(t, in, "demo", "demo", "left.csv", "right.csv")
+	// A live claim from another watcher: the run answers 429 and stays undone.
+	if err := os.MkdirAll(filepath.Join(out, "demo"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(out, "demo", claimName), []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wc := w.wc
+	wc.Once = true
+	err := Watch(context.Background(), wc)
+	if err == nil || !strings.Contains(err.Error(), "1 run(s) did not complete: demo") {
+		t.Fatalf("err=%v want undone run reported", err)
+	}
+
+	if err := os.Remove(filepath.Join(out, "demo", claimName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Watch(context.Background(), wc); err != nil {
+		t.Fatalf("Watch after claim released: %v", err)
+	}
+}